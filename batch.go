@@ -0,0 +1,177 @@
+package hnswindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// BatchItem is a vector to insert with InsertStream
+type BatchItem struct {
+	Name    []byte
+	Vector  []float32
+	Payload Payload
+}
+
+// BatchOptions controls how bulk inserts are committed
+type BatchOptions struct {
+	// CommitSize is the number of vectors written in each pebble batch.
+	// Default 1000
+	CommitSize int
+	// Progress, if set, is called after each batch is committed, with the
+	// number of vectors inserted and rejected so far
+	Progress func(inserted, failed int)
+}
+
+// BatchStats summarizes a bulk insert
+type BatchStats struct {
+	Inserted int
+	Failed   int
+	Errors   []*BatchError
+}
+
+// BatchError is the reason a single item of a bulk insert was rejected
+type BatchError struct {
+	Index int //position of the item in the input
+	Name  []byte
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("item %d (%s): %s", e.Index, e.Name, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// InsertBatch adds many named vectors, committing them in batches rather
+// than one at a time. Items that can't be inserted, such as duplicate names,
+// are skipped, and their errors returned in the matching position of the
+// error slice. The second error is set if a batch failed to commit, in
+// which case the items from that batch on were not inserted
+func (graph *Graph) InsertBatch(names [][]byte, vecs [][]float32) ([]error, error) {
+	return graph.InsertBatchWithOptions(names, vecs, BatchOptions{})
+}
+
+// InsertBatchWithOptions works like InsertBatch, with control over the
+// commit size and progress reporting
+func (graph *Graph) InsertBatchWithOptions(names [][]byte, vecs [][]float32, opts BatchOptions) ([]error, error) {
+	if len(names) != len(vecs) {
+		return nil, fmt.Errorf("%d names for %d vectors", len(names), len(vecs))
+	}
+	errs := make([]error, len(names))
+	items := make(chan BatchItem)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer close(items)
+		for i := range names {
+			select {
+			case items <- BatchItem{Name: names[i], Vector: vecs[i]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	stats, err := graph.InsertStream(ctx, items, opts)
+	for _, e := range stats.Errors {
+		errs[e.Index] = e
+	}
+	return errs, err
+}
+
+// InsertStream adds the vectors read from items until the channel is closed,
+// committing them in batches. Items that can't be inserted are skipped, and
+// listed in the returned stats. If ctx is cancelled, or a batch fails to
+// commit, the stats cover the batches committed so far
+func (graph *Graph) InsertStream(ctx context.Context, items <-chan BatchItem, opts BatchOptions) (BatchStats, error) {
+	if opts.CommitSize <= 0 {
+		opts.CommitSize = 1000
+	}
+	stats := BatchStats{}
+	offset := 0
+	chunk := make([]BatchItem, 0, opts.CommitSize)
+	for {
+		chunk = chunk[:0]
+		done := false
+		for len(chunk) < opts.CommitSize && !done {
+			select {
+			case item, ok := <-items:
+				if !ok {
+					done = true
+				} else {
+					chunk = append(chunk, item)
+				}
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			}
+		}
+		if len(chunk) > 0 {
+			inserted, errs, err := graph.insertChunk(chunk, offset)
+			if err != nil {
+				return stats, err
+			}
+			offset += len(chunk)
+			stats.Inserted += inserted
+			stats.Failed += len(errs)
+			stats.Errors = append(stats.Errors, errs...)
+			if opts.Progress != nil {
+				opts.Progress(stats.Inserted, stats.Failed)
+			}
+		}
+		if done {
+			return stats, nil
+		}
+	}
+}
+
+// insertChunk inserts items in a single batch. The graph is locked against
+// other writers until the batch is committed, so the batch can change any
+// neighbor list without locking nodes. Every insert reads through the batch,
+// so later items link to the earlier ones
+func (graph *Graph) insertChunk(items []BatchItem, offset int) (int, []*BatchError, error) {
+	graph.locks.write.Lock()
+	defer graph.locks.write.Unlock()
+	if err := graph.checkLive(); err != nil {
+		return 0, nil, err
+	}
+
+	batch := graph.db.db.NewIndexedBatch()
+	defer batch.Close()
+	view := graph.withReader(batch)
+
+	errs := []*BatchError{}
+	inserted := 0
+	for i, item := range items {
+		if err := graph.checkItem(item.Vector, item.Payload); err != nil {
+			errs = append(errs, &BatchError{Index: offset + i, Name: item.Name, Err: err})
+			continue
+		}
+		id, release, err := graph.reserveName(item.Name)
+		if errors.Is(err, ErrDuplicateName) {
+			errs = append(errs, &BatchError{Index: offset + i, Name: item.Name, Err: err})
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		defer release()
+
+		if err := view.insertNode(batch, id, item.Name, item.Vector, item.Payload); err != nil {
+			return 0, nil, err
+		}
+		plan, err := view.planLinks(id, graph.randomLevel(), item.Vector)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := view.writeLinks(batch, plan); err != nil {
+			return 0, nil, err
+		}
+		inserted++
+	}
+	if err := graph.commit(batch); err != nil {
+		return 0, nil, err
+	}
+	graph.size.Add(int64(inserted))
+	return inserted, errs, nil
+}
@@ -0,0 +1,107 @@
+package hnswindex
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+)
+
+// BuildOptions controls a parallel build
+type BuildOptions struct {
+	// Workers is the number of goroutines inserting vectors.
+	// Default runtime.GOMAXPROCS(0)
+	Workers int
+	// Seed seeds the random level picked for each vector. With one worker,
+	// building the same dataset into an empty graph with the same seed
+	// always produces the same graph. Zero picks a random seed
+	Seed uint64
+	// Progress, if set, is called after each vector is inserted or
+	// rejected, with the number handled so far. Calls are not concurrent
+	Progress func(done int)
+}
+
+// Builder inserts a dataset into a graph using several goroutines at once
+type Builder struct {
+	graph *Graph
+	opts  BuildOptions
+}
+
+// NewBuilder creates a Builder that inserts into graph
+func (graph *Graph) NewBuilder(opts BuildOptions) *Builder {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.Seed == 0 {
+		opts.Seed = rand.Uint64()
+	}
+	return &Builder{graph: graph, opts: opts}
+}
+
+// Build inserts the named vectors. Levels are drawn from the seed in input
+// order, before any vector is inserted, so they don't depend on how the
+// workers are scheduled. Vectors that can't be inserted, such as duplicate
+// names, are skipped, and their errors returned in the matching position
+// of the error slice. If ctx is cancelled, the workers stop, and ctx.Err()
+// is returned; vectors already inserted are kept
+func (b *Builder) Build(ctx context.Context, names [][]byte, vecs [][]float32) ([]error, error) {
+	return b.BuildWithPayloads(ctx, names, vecs, nil)
+}
+
+// BuildWithPayloads works like Build, storing payloads[i] with vecs[i].
+// payloads may be nil
+func (b *Builder) BuildWithPayloads(ctx context.Context, names [][]byte, vecs [][]float32, payloads []Payload) ([]error, error) {
+	if len(names) != len(vecs) {
+		return nil, fmt.Errorf("%d names for %d vectors", len(names), len(vecs))
+	}
+	if payloads != nil && len(payloads) != len(vecs) {
+		return nil, fmt.Errorf("%d payloads for %d vectors", len(payloads), len(vecs))
+	}
+	graph := b.graph
+	rng := rand.New(rand.NewPCG(b.opts.Seed, b.opts.Seed))
+	levels := make([]uint8, len(names))
+	for i := range levels {
+		levels[i] = graph.levelFor(rng.Float64())
+	}
+
+	errs := make([]error, len(names))
+	jobs := make(chan int)
+	progress := sync.Mutex{}
+	done := 0
+	wg := sync.WaitGroup{}
+	for w := 0; w < b.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var payload Payload
+				if payloads != nil {
+					payload = payloads[i]
+				}
+				graph.locks.write.RLock()
+				errs[i] = graph.insert(names[i], vecs[i], payload, levels[i])
+				graph.locks.write.RUnlock()
+				if b.opts.Progress != nil {
+					progress.Lock()
+					done++
+					b.opts.Progress(done)
+					progress.Unlock()
+				}
+			}
+		}()
+	}
+	var err error
+feed:
+	for i := range names {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return errs, err
+}
@@ -0,0 +1,158 @@
+package hnswindex
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// target size of each SSTable written by BulkLoad
+const bulkTableSize = 64 << 20
+
+// BulkOptions controls BulkLoad
+type BulkOptions struct {
+	BuildOptions //used to build the graph in memory
+	// TempDir is where the SSTables are written before they are ingested.
+	// Default os.TempDir()
+	TempDir string
+}
+
+// BulkLoad builds an empty graph from a whole dataset at once. The graph is
+// built with a Builder in a temporary in-memory store, then its keys are
+// written out in order to SSTables, and ingested into the DB, bypassing
+// the memtable and write-ahead log. The dataset must fit in memory.
+// Vectors that can't be inserted are skipped, and their errors returned in
+// the matching position of the error slice. payloads may be nil. Other
+// writes to the graph wait until the load is done. If anything fails, or
+// ctx is cancelled, the graph is left empty
+func (graph *Graph) BulkLoad(ctx context.Context, names [][]byte, vecs [][]float32, payloads []Payload, opts BulkOptions) ([]error, error) {
+	if err := graph.checkOnDisk("BulkLoad"); err != nil {
+		return nil, err
+	}
+	graph.locks.write.Lock()
+	defer graph.locks.write.Unlock()
+	if err := graph.checkLive(); err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range [][]byte{VectorGraphPrefix(graph.graphid), NameGraphPrefix(graph.graphid)} {
+		if found, err := graph.db.hasPrefix(prefix); err != nil {
+			return nil, err
+		} else if found {
+			return nil, fmt.Errorf("graph %s: bulk load needs an empty graph", graph.name)
+		}
+	}
+
+	mem, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+	tmp := &DB{db: mem}
+	tmp.noSync.Store(true)
+
+	//continue from the id counter of the graph, so ids aren't reused
+	counter := CounterKeyEncode(graph.graphid)
+	if val, closer, err := graph.db.db.Get(counter); err == nil {
+		err = mem.Set(counter, val, nil)
+		closer.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if err != pebble.ErrNotFound {
+		return nil, err
+	}
+
+	build := newGraph(tmp, graph.graphid, graph.name, graph.dim, graph.Config())
+	errs, err := build.NewBuilder(opts.BuildOptions).BuildWithPayloads(ctx, names, vecs, payloads)
+	if err != nil {
+		return nil, err
+	}
+
+	//outside the store, so a crash doesn't leave scratch files in it
+	dir, err := os.MkdirTemp(opts.TempDir, "hnsw-bulk-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	paths, err := writeTables(mem, dir, graph.db.db.FormatMajorVersion().MaxTableFormat())
+	if err != nil {
+		return nil, err
+	}
+	if err := graph.db.db.Ingest(paths); err != nil {
+		return nil, err
+	}
+
+	inserted := 0
+	for _, e := range errs {
+		if e == nil {
+			inserted++
+		}
+	}
+	graph.cache.clear()
+	graph.size.Add(int64(inserted))
+	return errs, nil
+}
+
+// writeTables copies every key of src, in order, into SSTables in dir,
+// starting a new table once one reaches bulkTableSize. Returns the paths of
+// the tables
+func writeTables(src *pebble.DB, dir string, format sstable.TableFormat) ([]string, error) {
+	iter, err := src.NewIter(&pebble.IterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	paths := []string{}
+	var w *sstable.Writer
+	for iter.First(); iter.Valid(); iter.Next() {
+		if w == nil {
+			path := filepath.Join(dir, fmt.Sprintf("%06d.sst", len(paths)))
+			f, err := vfs.Default.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			w = sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{TableFormat: format})
+			paths = append(paths, path)
+		}
+		if err := w.Set(iter.Key(), iter.Value()); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if w.EstimatedSize() >= bulkTableSize {
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			w = nil
+		}
+	}
+	if err := iter.Error(); err != nil {
+		if w != nil {
+			w.Close()
+		}
+		return nil, err
+	}
+	if w != nil {
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// hasPrefix reports whether any key starts with prefix
+func (db *DB) hasPrefix(prefix []byte) (bool, error) {
+	iter, err := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return iter.First(), iter.Error()
+}
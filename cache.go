@@ -0,0 +1,217 @@
+package hnswindex
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// number of stripes used to track cache invalidations
+const cacheStripes = 256
+
+// approximate memory used by a cache entry, besides its data
+const cacheEntryOverhead = 96
+
+// CacheStats reports how the node cache of a graph is being used
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// nodeCacheKey identifies a cached vector, or the friends of a node in a
+// layer. Vectors are stored with vector set
+type nodeCacheKey struct {
+	id     uint64
+	layer  uint8
+	vector bool
+}
+
+type nodeCacheEntry struct {
+	key     nodeCacheKey
+	vec     []float32
+	friends []uint64
+	size    int64
+}
+
+// nodeCache is an LRU cache of decoded vectors and neighbor lists, shared
+// by every Graph opened on the same DB with the same id. Only data read
+// from the DB itself is cached, never data read through an uncommitted
+// batch. Entries are invalidated after each batch that changes them is
+// committed. A read that started before an invalidation of the same stripe
+// is not cached, so a stale value read just before a commit can't be added
+// after it
+type nodeCache struct {
+	mutex   sync.Mutex
+	limit   *atomic.Int64 //size limit in bytes, shared with the DB
+	size    int64
+	entries map[nodeCacheKey]*list.Element
+	lru     *list.List
+	gens    [cacheStripes]uint64 //invalidation count of each stripe
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// SetCacheSize sets the number of bytes each graph may use to cache the
+// vectors and neighbor lists read by searches. Zero, the default, turns
+// caching off
+func (db *DB) SetCacheSize(bytes int64) {
+	db.cacheSize.Store(bytes)
+	db.graphCaches.Range(func(_, c any) bool {
+		c.(*nodeCache).shrink()
+		return true
+	})
+}
+
+func (db *DB) getGraphCache(graphId uint32) *nodeCache {
+	c, ok := db.graphCaches.Load(graphId)
+	if !ok {
+		c, _ = db.graphCaches.LoadOrStore(graphId, &nodeCache{
+			limit:   &db.cacheSize,
+			entries: map[nodeCacheKey]*list.Element{},
+			lru:     list.New(),
+		})
+	}
+	return c.(*nodeCache)
+}
+
+// CacheStats returns the statistics of the node cache of the graph
+func (graph *Graph) CacheStats() CacheStats {
+	c := graph.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+	}
+}
+
+// readCache returns the node cache, or nil if the graph reads through a
+// batch, or caching is off
+func (graph *Graph) readCache() *nodeCache {
+	if graph.reader != pebble.Reader(graph.db.db) || graph.cache.limit.Load() <= 0 {
+		return nil
+	}
+	return graph.cache
+}
+
+// commit commits a batch, then drops any cached vectors and neighbor lists
+// it changed, and updates the in-memory copy of a graph loaded in memory
+func (graph *Graph) commit(batch *pebble.Batch) error {
+	if err := batch.Commit(graph.db.writeOptions()); err != nil {
+		return err
+	}
+	graph.cache.invalidateBatch(graph.graphid, batch)
+	if graph.memory != nil {
+		return graph.memory.apply(graph.graphid, batch)
+	}
+	return nil
+}
+
+// get looks up a cached entry. On a miss, it returns the generation to
+// pass to put once the value has been read
+func (c *nodeCache) get(key nodeCacheKey) (*nodeCacheEntry, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		return e.Value.(*nodeCacheEntry), 0
+	}
+	c.misses++
+	return nil, c.gens[key.id%cacheStripes]
+}
+
+// put adds an entry read at generation gen, unless its stripe has been
+// invalidated since
+func (c *nodeCache) put(entry *nodeCacheEntry, gen uint64) {
+	entry.size = cacheEntryOverhead + int64(4*len(entry.vec)+8*len(entry.friends))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.gens[entry.key.id%cacheStripes] != gen {
+		return
+	}
+	if _, ok := c.entries[entry.key]; ok {
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	c.evict()
+}
+
+func (c *nodeCache) shrink() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits its
+// limit. The mutex must be held
+func (c *nodeCache) evict() {
+	limit := c.limit.Load()
+	for c.size > limit && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *nodeCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*nodeCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// invalidateBatch drops the entries for every vector and neighbor list
+// written or deleted by a committed batch
+func (c *nodeCache) invalidateBatch(graphId uint32, batch *pebble.Batch) {
+	keys := []nodeCacheKey{}
+	r := batch.Reader()
+	for {
+		_, key, _, ok, err := r.Next()
+		if !ok || err != nil {
+			break
+		}
+		switch {
+		case len(key) == 13 && key[0] == vectorPrefix:
+			if g, id := VectorKeyParse(key); g == graphId {
+				keys = append(keys, nodeCacheKey{id: id, vector: true})
+			}
+		case len(key) == 26 && key[0] == layerPrefix:
+			if g, layer, src, _ := LayerKeyParse(key); g == graphId {
+				keys = append(keys, nodeCacheKey{id: src, layer: layer})
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, k := range keys {
+		c.gens[k.id%cacheStripes]++
+		if e, ok := c.entries[k]; ok {
+			c.remove(e)
+		}
+	}
+}
+
+// clear drops every entry, after the graph is emptied or replaced
+func (c *nodeCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range c.gens {
+		c.gens[i]++
+	}
+	c.entries = map[nodeCacheKey]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+}
@@ -0,0 +1,79 @@
+package hnswindex
+
+import (
+	"fmt"
+	"math"
+)
+
+// GraphConfig holds the construction parameters of a graph. They are
+// stored in the graph catalog, so a reopened graph keeps building the same
+// way. Zero values are replaced with the defaults described on each field
+type GraphConfig struct {
+	M              int     //friends picked for a new node, and the limit in layers above 0. Default 16
+	Mmax0          int     //limit on friends per node in layer 0. Default 2*M
+	EfConstruction int     //candidate list size used while inserting. Default 200
+	ML             float64 //level multiplier, a node reaches layer l with probability exp(-l/ML). Default 1/ln(M)
+	Metric         Metric  //distance function. Default EuclideanMetric
+
+	// ExtendCandidates also considers the friends of each candidate when
+	// selecting neighbors, which helps on highly clustered data
+	ExtendCandidates bool
+	// KeepPrunedConnections fills any free friend slots with the closest of
+	// the candidates the selection heuristic rejected
+	KeepPrunedConnections bool
+}
+
+// DefaultGraphConfig returns the parameters used by common HNSW libraries
+func DefaultGraphConfig() GraphConfig {
+	return GraphConfig{}.withDefaults()
+}
+
+func (c GraphConfig) withDefaults() GraphConfig {
+	if c.M == 0 {
+		c.M = 16
+	}
+	if c.Mmax0 == 0 {
+		c.Mmax0 = 2 * c.M
+	}
+	if c.EfConstruction == 0 {
+		c.EfConstruction = 200
+	}
+	if c.ML == 0 && c.M > 1 {
+		c.ML = 1 / math.Log(float64(c.M))
+	}
+	if c.Metric == nil {
+		c.Metric = EuclideanMetric
+	}
+	return c
+}
+
+func (c GraphConfig) validate(dim int) error {
+	if dim < 1 {
+		return fmt.Errorf("dim must be positive")
+	}
+	if c.M < 2 {
+		return fmt.Errorf("M must be at least 2")
+	}
+	if c.Mmax0 < c.M {
+		return fmt.Errorf("Mmax0 (%d) must be at least M (%d)", c.Mmax0, c.M)
+	}
+	if c.EfConstruction < 1 {
+		return fmt.Errorf("EfConstruction must be positive")
+	}
+	if c.ML <= 0 {
+		return fmt.Errorf("ML must be positive")
+	}
+	return nil
+}
+
+// equal compares the stored parameters of two configs
+func (c GraphConfig) equal(o GraphConfig) bool {
+	return c.M == o.M && c.Mmax0 == o.Mmax0 && c.EfConstruction == o.EfConstruction &&
+		c.ML == o.ML && c.Metric.Name() == o.Metric.Name() &&
+		c.ExtendCandidates == o.ExtendCandidates && c.KeepPrunedConnections == o.KeepPrunedConnections
+}
+
+func (c GraphConfig) String() string {
+	return fmt.Sprintf("M=%d Mmax0=%d efConstruction=%d mL=%g metric=%s extendCandidates=%t keepPrunedConnections=%t",
+		c.M, c.Mmax0, c.EfConstruction, c.ML, c.Metric.Name(), c.ExtendCandidates, c.KeepPrunedConnections)
+}
@@ -2,68 +2,409 @@ package hnswindex
 
 import (
 	"bytes"
-	"math"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cockroachdb/pebble"
 )
 
 type DB struct {
-	db *pebble.DB
+	db          *pebble.DB
+	mutex       sync.Mutex
+	graphLocks  sync.Map //graph id to *graphLocks
+	graphCaches sync.Map //graph id to *nodeCache
+	cacheSize   atomic.Int64
+	noSync      atomic.Bool
+	exactScan   atomic.Pointer[float64] //nil for the default, see SetExactScanFraction
 }
 
+var ErrGraphNotFound = errors.New("graph not found")
+var ErrNameNotFound = errors.New("name not found")
+var ErrDuplicateName = errors.New("duplicate name")
+
 func New(path string) (*DB, error) {
 	db, err := pebble.Open(path, &pebble.Options{})
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return &DB{db: db}, nil
 }
 
 func (db *DB) Close() {
 	db.db.Close()
 }
 
+// SetSync controls whether inserts, deletes and updates wait for their
+// writes to reach disk before returning. It is on by default. With it
+// off, writes are faster, and each is still atomic, but the most recent
+// ones can be lost if the machine crashes. Graph catalog changes are
+// always synced
+func (db *DB) SetSync(sync bool) {
+	db.noSync.Store(!sync)
+}
+
+func (db *DB) writeOptions() *pebble.WriteOptions {
+	if db.noSync.Load() {
+		return pebble.NoSync
+	}
+	return pebble.Sync
+}
+
+// NewGraph creates a graph using the Euclidean metric, and records its
+// parameters in the graph catalog. efCount is the EfConstruction of the
+// graph, the rest of its GraphConfig is derived from M. If a graph with the
+// same name already exists, it is opened instead, as long as the parameters
+// match the stored ones.
 func (db *DB) NewGraph(name string, dim int, M uint8, efCount int) (*Graph, error) {
-	h := Graph{name: name, m: M, db: db, dim: dim, efCount: efCount}
-	// default values used in c++ implementation
-	h.levelMult = 1 / math.Log(float64(M))
-	return &h, nil
+	return db.NewGraphWithMetric(name, dim, M, efCount, EuclideanMetric)
+}
+
+// NewGraphWithMetric creates a graph that uses metric for all distance
+// calculations. Custom metrics must be registered with RegisterMetric so
+// the graph can be reopened.
+func (db *DB) NewGraphWithMetric(name string, dim int, M uint8, efCount int, metric Metric) (*Graph, error) {
+	if M < 2 {
+		return nil, fmt.Errorf("graph %s: M must be at least 2", name)
+	}
+	return db.NewGraphWithConfig(name, dim, GraphConfig{M: int(M), EfConstruction: efCount, Metric: metric})
+}
+
+// NewGraphWithConfig creates a graph with the construction parameters in
+// config, filling in defaults for any left unset. If a graph with the same
+// name already exists, it is opened instead, as long as the parameters match
+// the stored ones.
+func (db *DB) NewGraphWithConfig(name string, dim int, config GraphConfig) (*Graph, error) {
+	config = config.withDefaults()
+	if err := config.validate(dim); err != nil {
+		return nil, fmt.Errorf("graph %s: %w", name, err)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := GraphKeyEncode([]byte(name))
+	val, closer, err := db.db.Get(key)
+	if err == nil {
+		graphId, sDim, sConfig, sMetric := GraphValueParse(val)
+		closer.Close()
+		sConfig.Metric, err = MetricByName(sMetric)
+		if err != nil {
+			return nil, fmt.Errorf("graph %s: %w", name, err)
+		}
+		if sDim != dim || !sConfig.equal(config) {
+			return nil, fmt.Errorf("graph %s exists with different parameters: dim=%d %s (requested dim=%d %s)",
+				name, sDim, sConfig, dim, config)
+		}
+		return newGraph(db, graphId, name, dim, sConfig), nil
+	}
+	if err != pebble.ErrNotFound {
+		return nil, err
+	}
+
+	graphId, err := db.newGraphID()
+	if err != nil {
+		return nil, err
+	}
+	batch := db.db.NewBatch()
+	defer batch.Close()
+	batch.Set(GraphCounterKey(), GraphCounterValueEncode(graphId), nil)
+	batch.Set(key, GraphValueEncode(graphId, dim, config), nil)
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return nil, err
+	}
+	return newGraph(db, graphId, name, dim, config), nil
+}
+
+// OpenGraph restores a graph previously created with NewGraph
+func (db *DB) OpenGraph(name string) (*Graph, error) {
+	//held so the graph can't be dropped between reading the catalog and
+	//getting its locks
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	val, closer, err := db.db.Get(GraphKeyEncode([]byte(name)))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrGraphNotFound, name)
+		}
+		return nil, err
+	}
+	defer closer.Close()
+	graphId, dim, config, metricName := GraphValueParse(val)
+	config.Metric, err = MetricByName(metricName)
+	if err != nil {
+		return nil, fmt.Errorf("graph %s: %w", name, err)
+	}
+	return newGraph(db, graphId, name, dim, config), nil
+}
+
+type GraphInfo struct {
+	Name    string
+	ID      uint32
+	Dim     int
+	Config  GraphConfig //Config.Metric is nil if the metric is not registered
+	Metric  string
+	Count   uint64 //counted by ListGraphs, see there
+	Deleted uint64 //entries marked deleted, waiting to be vacuumed
+}
+
+// ListGraphs returns the catalog entry and vector count of every graph.
+// Count and Deleted are not stored, they are found by scanning the name and
+// tombstone keys of every graph, so the call takes time proportional to the
+// total number of vectors in the DB. Keeping a stored count up to date would
+// mean a write to one shared key in every insert and delete, serializing
+// writers, so avoid calling it in a hot path
+func (db *DB) ListGraphs() ([]GraphInfo, error) {
+	prefix := GraphPrefix()
+	iter, err := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	out := []GraphInfo{}
+	for iter.SeekGE(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		graphId, dim, config, metric := GraphValueParse(iter.Value())
+		config.Metric, _ = MetricByName(metric)
+		count, err := db.countKeys(NameRevGraphPrefix(graphId))
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := db.countKeys(TombstoneGraphPrefix(graphId))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, GraphInfo{
+			Name: string(GraphKeyParse(iter.Key())), ID: graphId,
+			Dim: dim, Config: config, Metric: metric, Count: count, Deleted: deleted,
+		})
+	}
+	return out, nil
+}
+
+// DropGraph removes a graph from the catalog and deletes all of its
+// names, vectors, payloads, layer edges and entry point. It waits for
+// writes in progress to finish; later writes through handles to the graph
+// fail with ErrGraphNotFound
+func (db *DB) DropGraph(name string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := GraphKeyEncode([]byte(name))
+	graphId, err := db.getGraphID(key)
+	if err != nil {
+		return err
+	}
+	locks := db.getGraphLocks(graphId)
+	locks.write.Lock()
+	defer locks.write.Unlock()
+
+	batch := db.db.NewBatch()
+	defer batch.Close()
+	for _, prefix := range graphPrefixes(graphId) {
+		if err := batch.DeleteRange(prefix, PrefixEnd(prefix), nil); err != nil {
+			return err
+		}
+	}
+	if err := batch.Delete(key, nil); err != nil {
+		return err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	locks.dropped = true
+	db.graphLocks.Delete(graphId)
+	if c, ok := db.graphCaches.LoadAndDelete(graphId); ok {
+		c.(*nodeCache).clear()
+	}
+	return nil
+}
+
+// RenameGraph changes the name of a graph in the catalog. Stored data
+// is keyed by graph id, so only the catalog entry is moved
+func (db *DB) RenameGraph(oldName, newName string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	oldKey := GraphKeyEncode([]byte(oldName))
+	newKey := GraphKeyEncode([]byte(newName))
+	val, closer, err := db.db.Get(oldKey)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return fmt.Errorf("%w: %s", ErrGraphNotFound, oldName)
+		}
+		return err
+	}
+	value := bytes.Clone(val)
+	closer.Close()
+
+	if _, closer, err := db.db.Get(newKey); err == nil {
+		closer.Close()
+		return fmt.Errorf("graph %s already exists", newName)
+	} else if err != pebble.ErrNotFound {
+		return err
+	}
+
+	batch := db.db.NewBatch()
+	defer batch.Close()
+	batch.Set(newKey, value, nil)
+	batch.Delete(oldKey, nil)
+	return batch.Commit(pebble.Sync)
 }
 
-func (db *DB) insertGraphVector(graphid uint32, name []byte, vec []float32) (uint64, error) {
-	//TODO: add mutex
-	nameKey := NameKeyEncode(graphid, name)
-	nameId, err := db.newVectorID(graphid)
+func (db *DB) getGraphID(key []byte) (uint32, error) {
+	val, closer, err := db.db.Get(key)
 	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, fmt.Errorf("%w: %s", ErrGraphNotFound, GraphKeyParse(key))
+		}
 		return 0, err
 	}
-	nameValue := NameValueEncode(nameId)
+	defer closer.Close()
+	graphId, _, _, _ := GraphValueParse(val)
+	return graphId, nil
+}
 
-	db.db.Set(nameKey, nameValue, nil)
+// graphPrefixes lists the key prefixes of all records belonging to a graph
+func graphPrefixes(graphId uint32) [][]byte {
+	return [][]byte{
+		NameGraphPrefix(graphId),
+		NameRevGraphPrefix(graphId),
+		VectorGraphPrefix(graphId),
+		LayerGraphPrefixEncode(graphId),
+		LayerRevGraphPrefixEncode(graphId),
+		EntryKeyEncode(graphId),
+		CounterKeyEncode(graphId),
+		LevelGraphPrefix(graphId),
+		TombstoneGraphPrefix(graphId),
+		PayloadGraphPrefix(graphId),
+		IndexGraphPrefix(graphId),
+	}
+}
 
-	vecKey := VectorKeyEncode(graphid, nameId)
-	vecValue := VectorValueEncode(vec)
-	db.db.Set(vecKey, vecValue, nil)
-	db.db.Set(NameRevKeyEncode(graphid, nameId), name, nil)
+func (db *DB) countKeys(prefix []byte) (uint64, error) {
+	iter, err := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	count := uint64(0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		count++
+	}
+	return count, nil
+}
 
-	return nameId, nil
+func newGraph(db *DB, graphId uint32, name string, dim int, config GraphConfig) *Graph {
+	return &Graph{
+		graphid:               graphId,
+		name:                  name,
+		db:                    db,
+		reader:                db.db,
+		locks:                 db.getGraphLocks(graphId),
+		cache:                 db.getGraphCache(graphId),
+		dim:                   dim,
+		maxM:                  config.M,
+		maxM0:                 config.Mmax0,
+		efConstruction:        config.EfConstruction,
+		levelMult:             config.ML,
+		metric:                config.Metric,
+		extendCandidates:      config.ExtendCandidates,
+		keepPrunedConnections: config.KeepPrunedConnections,
+	}
 }
 
-func (db *DB) newVectorID(graphId uint32) (uint64, error) {
-	prefix := NameRevGraphPrefix(graphId)
+// Config returns the construction parameters of the graph
+func (graph *Graph) Config() GraphConfig {
+	return GraphConfig{
+		M:                     graph.maxM,
+		Mmax0:                 graph.maxM0,
+		EfConstruction:        graph.efConstruction,
+		ML:                    graph.levelMult,
+		Metric:                graph.metric,
+		ExtendCandidates:      graph.extendCandidates,
+		KeepPrunedConnections: graph.keepPrunedConnections,
+	}
+}
+
+// newGraphID returns the id after the one stored in the graph counter,
+// which the caller must write back along with the catalog entry. Ids start
+// at 1. Caller must hold db.mutex
+func (db *DB) newGraphID() (uint32, error) {
+	val, closer, err := db.db.Get(GraphCounterKey())
+	if err == nil {
+		defer closer.Close()
+		return GraphCounterValueParse(val) + 1, nil
+	}
+	if err != pebble.ErrNotFound {
+		return 0, err
+	}
+	//DBs written before the counter existed start after the largest id in
+	//the catalog
+	prefix := GraphPrefix()
 	iter, err := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix})
 	if err != nil {
 		return 0, err
 	}
 	defer iter.Close()
-	//TODO: there is probably a more efficient way to do this, like starting above and going backward
-	maxID := uint64(0)
+	maxID := uint32(0)
 	for iter.SeekGE(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
-		_, maxID = NameRevKeyParse(iter.Key())
+		graphId, _, _, _ := GraphValueParse(iter.Value())
+		if graphId > maxID {
+			maxID = graphId
+		}
 	}
 	return maxID + 1, nil
 }
 
+// insertGraphVector adds the name, reverse name and vector of a new entry
+// to a batch
+func insertGraphVector(w pebble.Writer, graphid uint32, name []byte, nameId uint64, vec []float32) error {
+	if err := w.Set(NameKeyEncode(graphid, name), NameValueEncode(nameId), nil); err != nil {
+		return err
+	}
+	if err := w.Set(VectorKeyEncode(graphid, nameId), VectorValueEncode(vec), nil); err != nil {
+		return err
+	}
+	return w.Set(NameRevKeyEncode(graphid, nameId), name, nil)
+}
+
+func (db *DB) newVectorID(graphId uint32) (uint64, error) {
+	return db.getGraphLocks(graphId).ids.allocate(db, graphId)
+}
+
+// maxVectorID scans the stored names of a graph for the largest id. It is
+// only used to start the id counter of graphs written before it existed
+func (db *DB) maxVectorID(graphId uint32) (uint64, error) {
+	prefix := NameRevGraphPrefix(graphId)
+	iter, err := db.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	maxID := uint64(0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		//ids are little endian encoded, so the keys are not in numeric order
+		if _, id := NameRevKeyParse(iter.Key()); id > maxID {
+			maxID = id
+		}
+	}
+	return maxID, nil
+}
+
+func (db *DB) getVectorID(graphId uint32, name []byte) (uint64, error) {
+	val, closer, err := db.db.Get(NameKeyEncode(graphId, name))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, fmt.Errorf("%w: %s", ErrNameNotFound, name)
+		}
+		return 0, err
+	}
+	defer closer.Close()
+	return NameValueParse(val), nil
+}
+
 func (db *DB) getVectorName(graphId uint32, id uint64) ([]byte, error) {
 
 	key := NameRevKeyEncode(graphId, id)
@@ -0,0 +1,317 @@
+package hnswindex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/bmeg/hnsw-index/distqueue"
+	"github.com/cockroachdb/pebble"
+)
+
+// Delete removes a vector from the graph. Edges to and from the node are
+// removed in every layer, and the nodes that linked to it are reconnected
+// to its former neighbors so the graph stays navigable.
+func (graph *Graph) Delete(name []byte) error {
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	if err := graph.checkLive(); err != nil {
+		return err
+	}
+	//the name is held until the delete is committed, so writers of the
+	//same name run one at a time
+	id, stored, release, err := graph.claimName(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if !stored {
+		return fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+	_, _, err = graph.deleteNode(id, name, nil, false)
+	return err
+}
+
+// deleteNode removes a node and all of its edges in a single batch, returning
+// the number of edges removed. Nodes in exclude are not used when repairing
+// the links of former neighbors. If tombstoned is set, the node is only
+// removed if it is still marked deleted once it is locked, as Upsert may
+// have replaced it; the returned bool reports whether it was removed. If
+// name no longer maps to id, ErrNameNotFound is returned. The caller must
+// hold locks.write for reading, and the name
+func (graph *Graph) deleteNode(id uint64, name []byte, exclude map[uint64]bool, tombstoned bool) (int, bool, error) {
+	unlock, _, err := graph.lockNeighborhood(id)
+	if err != nil {
+		return 0, false, err
+	}
+	defer unlock()
+	if cur, err := graph.db.getVectorID(graph.graphid, name); err != nil {
+		return 0, false, err
+	} else if cur != id {
+		return 0, false, fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+	if tombstoned {
+		if deleted, err := graph.isDeleted(id); err != nil || !deleted {
+			return 0, false, err
+		}
+	}
+
+	batch := graph.db.db.NewIndexedBatch()
+	defer batch.Close()
+
+	edges, err := graph.withReader(batch).unlinkNode(batch, id, exclude)
+	if err != nil {
+		return 0, false, err
+	}
+	batch.Delete(NameKeyEncode(graph.graphid, name), nil)
+	batch.Delete(NameRevKeyEncode(graph.graphid, id), nil)
+	batch.Delete(VectorKeyEncode(graph.graphid, id), nil)
+	batch.Delete(TombstoneKeyEncode(graph.graphid, id), nil)
+	if err := graph.setPayload(batch, id, nil); err != nil {
+		return 0, false, err
+	}
+
+	batch.Delete(LevelKeyEncode(graph.graphid, id), nil)
+
+	graph.locks.entry.Lock()
+	defer graph.locks.entry.Unlock()
+	ep, eLevel, err := graph.getEntryID()
+	if err != nil {
+		return 0, false, err
+	}
+	if ep == id {
+		newEp, newLevel, err := graph.findEntryPoint(id, eLevel)
+		if err != nil {
+			return 0, false, err
+		}
+		if newEp == 0 {
+			batch.Delete(EntryKeyEncode(graph.graphid), nil)
+		} else {
+			batch.Set(EntryKeyEncode(graph.graphid), EntryValueEncode(newEp, newLevel), nil)
+		}
+	}
+	if err := graph.commit(batch); err != nil {
+		return 0, false, err
+	}
+	graph.size.Add(-1)
+	return edges, true, nil
+}
+
+// vacuumNode removes a node listed by Vacuum, unless it was deleted or
+// replaced since the tombstones were listed. Returns the number of edges
+// removed, and whether the node was removed
+func (graph *Graph) vacuumNode(id uint64, exclude map[uint64]bool) (int, bool, error) {
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	if err := graph.checkLive(); err != nil {
+		return 0, false, err
+	}
+	name, err := graph.db.getVectorName(graph.graphid, id)
+	if err == pebble.ErrNotFound {
+		//removed by a concurrent Delete
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	_, _, release, err := graph.claimName(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+	edges, removed, err := graph.deleteNode(id, name, exclude, true)
+	if errors.Is(err, ErrNameNotFound) {
+		//deleted and inserted again under a new id
+		return 0, false, nil
+	}
+	return edges, removed, err
+}
+
+// unlinkNode adds the removal of every edge to and from a node to the batch,
+// along with the edges needed to reconnect its former neighbors. Returns the
+// number of edges removed
+func (graph *Graph) unlinkNode(batch *pebble.Batch, id uint64, exclude map[uint64]bool) (int, error) {
+	level, err := graph.getNodeLevel(id)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for l := 0; l <= int(level); l++ {
+		out, err := graph.getLayerLinks(uint8(l), id)
+		if err != nil {
+			return 0, err
+		}
+		in, err := graph.getLayerRevLinks(uint8(l), id)
+		if err != nil {
+			return 0, err
+		}
+		if len(out) == 0 && len(in) == 0 {
+			continue
+		}
+		for _, e := range out {
+			graph.deleteLink(batch, uint8(l), e)
+		}
+		for _, e := range in {
+			graph.deleteLink(batch, uint8(l), e)
+		}
+		count += len(out) + len(in)
+		if err := graph.repairLinks(batch, uint8(l), id, in, out, exclude); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// repairLinks connects each node that pointed at the removed node to the
+// removed node's former neighbors. Friends lists that overflow are pruned
+// with the neighbor selection heuristic
+func (graph *Graph) repairLinks(batch *pebble.Batch, layer uint8, id uint64, in, out []*LayerEdge, exclude map[uint64]bool) error {
+	skip := map[uint64]bool{id: true}
+	for n := range exclude {
+		skip[n] = true
+	}
+	//Upsert may have cleared the tombstones of neighbors since exclude was
+	//listed, and they can be linked to again
+	neighbors := make([]uint64, 0, len(in)+len(out))
+	for _, e := range in {
+		neighbors = append(neighbors, e.Source)
+	}
+	for _, e := range out {
+		neighbors = append(neighbors, e.Dest)
+	}
+	for _, n := range neighbors {
+		if !exclude[n] {
+			continue
+		}
+		if deleted, err := graph.isDeleted(n); err != nil {
+			return err
+		} else if !deleted {
+			delete(skip, n)
+		}
+	}
+	for _, src := range in {
+		n := src.Source
+		if skip[n] {
+			continue
+		}
+		nVec, err := graph.getVec(n)
+		if err == pebble.ErrNotFound {
+			//removed by a concurrent delete
+			continue
+		} else if err != nil {
+			return err
+		}
+		links, err := graph.getLayerLinks(layer, n)
+		if err != nil {
+			return err
+		}
+		linked := map[uint64]bool{n: true}
+		existing := make([]*LayerEdge, 0, len(links))
+		for _, e := range links {
+			if e.Dest != id {
+				linked[e.Dest] = true
+				existing = append(existing, e)
+			}
+		}
+		cands := make([]uint64, 0, len(out))
+		for _, e := range out {
+			if !linked[e.Dest] && !skip[e.Dest] {
+				cands = append(cands, e.Dest)
+			}
+		}
+		if len(cands) == 0 {
+			continue
+		}
+		cands, cDists, err := graph.getDistances(nVec, cands)
+		if err != nil {
+			return err
+		}
+		if len(existing)+len(cands) <= graph.maxConnections(layer) {
+			for i := range cands {
+				graph.setLink(batch, layer, n, cands[i], cDists[i])
+			}
+			continue
+		}
+		added := make([]distqueue.Element[float32, uint64], len(cands))
+		for i := range cands {
+			added[i] = distqueue.Element[float32, uint64]{Dist: cDists[i], Value: cands[i]}
+		}
+		if err := graph.pruneLinks(batch, layer, n, nVec, existing, added, skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findEntryPoint picks a replacement entry point from the highest layer
+// at or below maxLevel that has edges, falling back to any stored vector.
+// Returns the new entry point and its level
+func (graph *Graph) findEntryPoint(exclude uint64, maxLevel uint8) (uint64, uint8, error) {
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer iter.Close()
+	for l := int(maxLevel); l >= 0; l-- {
+		prefix := LayerPrefixEncode(graph.graphid, uint8(l))
+		for iter.SeekGE(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+			_, _, src, _ := LayerKeyParse(iter.Key())
+			if src != exclude {
+				level, err := graph.getNodeLevel(src)
+				return src, level, err
+			}
+		}
+	}
+	prefix := NameRevGraphPrefix(graph.graphid)
+	for iter.SeekGE(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		_, id := NameRevKeyParse(iter.Key())
+		if id != exclude {
+			level, err := graph.getNodeLevel(id)
+			return id, level, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// getLayerLinks returns the outgoing edges of a node in a layer
+func (graph *Graph) getLayerLinks(l uint8, a uint64) ([]*LayerEdge, error) {
+	prefix := LayerKeyPrefixEncode(graph.graphid, l, a)
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	out := []*LayerEdge{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, _, src, dist := LayerKeyParse(iter.Key())
+		out = append(out, &LayerEdge{Source: src, Dest: LayerValueParse(iter.Value()), Dist: dist})
+	}
+	return out, nil
+}
+
+// getLayerRevLinks returns the incoming edges of a node in a layer
+func (graph *Graph) getLayerRevLinks(l uint8, a uint64) ([]*LayerEdge, error) {
+	prefix := LayerRevKeyPrefixEncode(graph.graphid, l, a)
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	out := []*LayerEdge{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, _, dest, src := LayerRevKeyParse(iter.Key())
+		out = append(out, &LayerEdge{Source: src, Dest: dest, Dist: LayerRevValueParse(iter.Value())})
+	}
+	return out, nil
+}
+
+func (graph *Graph) setLink(batch *pebble.Batch, layer uint8, src uint64, dst uint64, dist float32) {
+	k, v := graph.genInsertLink(graph.graphid, layer, src, dst, dist)
+	batch.Set(k, v, nil)
+	k, v = graph.genInsertRevLink(graph.graphid, layer, src, dst, dist)
+	batch.Set(k, v, nil)
+}
+
+func (graph *Graph) deleteLink(batch *pebble.Batch, layer uint8, e *LayerEdge) {
+	batch.Delete(LayerKeyEncode(graph.graphid, layer, e.Source, e.Dist, e.Dest), nil)
+	batch.Delete(LayerRevKeyEncode(graph.graphid, layer, e.Dest, e.Source), nil)
+}
@@ -1,12 +1,108 @@
 package hnswindex
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Metric is the distance function used to build and search a graph.
+// The name is stored in the graph catalog, so a graph is always reopened
+// with the metric it was built with
+type Metric interface {
+	Name() string
+	Distance(a []float32, b []float32) float32
+}
+
+type euclideanMetric struct{}
+type squaredL2Metric struct{}
+type cosineMetric struct{}
+type innerProductMetric struct{}
+type manhattanMetric struct{}
+
+var (
+	EuclideanMetric    Metric = euclideanMetric{}
+	SquaredL2Metric    Metric = squaredL2Metric{}
+	CosineMetric       Metric = cosineMetric{}
+	InnerProductMetric Metric = innerProductMetric{}
+	ManhattanMetric    Metric = manhattanMetric{}
+)
+
+var metricLock sync.RWMutex
+var metrics = map[string]Metric{}
+
+func init() {
+	for _, m := range []Metric{EuclideanMetric, SquaredL2Metric, CosineMetric, InnerProductMetric, ManhattanMetric} {
+		metrics[m.Name()] = m
+	}
+}
+
+// RegisterMetric adds a custom metric, so graphs built with it can be reopened
+func RegisterMetric(m Metric) {
+	metricLock.Lock()
+	defer metricLock.Unlock()
+	metrics[m.Name()] = m
+}
+
+// MetricByName finds a built in or registered metric
+func MetricByName(name string) (Metric, error) {
+	metricLock.RLock()
+	defer metricLock.RUnlock()
+	if m, ok := metrics[name]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown metric: %s", name)
+}
+
+func (euclideanMetric) Name() string                    { return "euclidean" }
+func (euclideanMetric) Distance(a, b []float32) float32 { return Euclidean(a, b) }
+
+func (squaredL2Metric) Name() string                    { return "l2sq" }
+func (squaredL2Metric) Distance(a, b []float32) float32 { return SquaredEuclidean(a, b) }
+
+func (cosineMetric) Name() string                    { return "cosine" }
+func (cosineMetric) Distance(a, b []float32) float32 { return CosineDistance(a, b) }
+
+// inner product distance is 1 - a.b, so the nearest neighbors are the
+// vectors with the largest inner product
+func (innerProductMetric) Name() string                    { return "ip" }
+func (innerProductMetric) Distance(a, b []float32) float32 { return 1 - Dot(a, b) }
+
+func (manhattanMetric) Name() string                    { return "manhattan" }
+func (manhattanMetric) Distance(a, b []float32) float32 { return Manhattan(a, b) }
 
 func Euclidean(a []float32, b []float32) float32 {
+	return float32(math.Sqrt(float64(SquaredEuclidean(a, b))))
+}
+
+// SquaredEuclidean, Dot and CosineDistance use the fastest kernel the CPU
+// supports, see DistanceKernel
+func SquaredEuclidean(a []float32, b []float32) float32 {
+	return activeKernel.Load().squaredL2(a, b)
+}
+
+func Dot(a []float32, b []float32) float32 {
+	return activeKernel.Load().dot(a, b)
+}
+
+// CosineDistance is 1 - the cosine similarity of a and b. Zero length
+// vectors are treated as orthogonal to everything
+func CosineDistance(a []float32, b []float32) float32 {
+	dot, na, nb := activeKernel.Load().cosine(a, b)
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/float32(math.Sqrt(float64(na)*float64(nb)))
+}
+
+func Manhattan(a []float32, b []float32) float32 {
 	s := float32(0.0)
 	for i := range a {
 		x := a[i] - b[i]
-		s += (x * x)
+		if x < 0 {
+			x = -x
+		}
+		s += x
 	}
-	return float32(math.Sqrt(float64(s)))
+	return s
 }
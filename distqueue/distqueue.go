@@ -11,6 +11,10 @@ type Element[D constraints.Ordered, V any] struct {
 	Value V
 }
 
+// The queues are binary heaps stored in a slice. Ranging over a queue visits
+// every element, but not in order; use Ascending, Descending or Sorted for that.
+// DistQueueMinCapped keeps the c nearest elements inserted, with the
+// farthest of them at the root, so it can be replaced cheaply
 type DistQueueMinCapped[D constraints.Ordered, V any] []Element[D, V]
 type DistQueueMax[D constraints.Ordered, V any] []Element[D, V]
 type DistQueueMin[D constraints.Ordered, V any] []Element[D, V]
@@ -35,6 +39,64 @@ func maxSort[D constraints.Ordered, V any](a, b Element[D, V]) int {
 	return 0
 }
 
+func nearer[D constraints.Ordered](a, b D) bool {
+	return a < b
+}
+
+func farther[D constraints.Ordered](a, b D) bool {
+	return a > b
+}
+
+// up moves the element at i toward the root until its parent comes before
+// it. before(a, b) reports whether a belongs above b
+func up[D constraints.Ordered, V any](h []Element[D, V], i int, before func(a, b D) bool) {
+	for i > 0 {
+		p := (i - 1) / 2
+		if !before(h[i].Dist, h[p].Dist) {
+			return
+		}
+		h[i], h[p] = h[p], h[i]
+		i = p
+	}
+}
+
+// down moves the element at i away from the root until neither of its
+// children comes before it
+func down[D constraints.Ordered, V any](h []Element[D, V], i int, before func(a, b D) bool) {
+	n := len(h)
+	for {
+		c := 2*i + 1
+		if c >= n {
+			return
+		}
+		if r := c + 1; r < n && before(h[r].Dist, h[c].Dist) {
+			c = r
+		}
+		if !before(h[c].Dist, h[i].Dist) {
+			return
+		}
+		h[i], h[c] = h[c], h[i]
+		i = c
+	}
+}
+
+// pop removes the root of a heap
+func pop[D constraints.Ordered, V any](h []Element[D, V], before func(a, b D) bool) (Element[D, V], []Element[D, V]) {
+	out := h[0]
+	last := len(h) - 1
+	h[0] = h[last]
+	h = h[:last]
+	down(h, 0, before)
+	return out, h
+}
+
+// sorted returns a copy of the elements of a heap, ordered by cmp
+func sorted[D constraints.Ordered, V any](h []Element[D, V], cmp func(a, b Element[D, V]) int) []Element[D, V] {
+	out := slices.Clone(h)
+	slices.SortFunc(out, cmp)
+	return out
+}
+
 //
 
 func NewMinCapped[D constraints.Ordered, V any](c int) DistQueueMinCapped[D, V] {
@@ -54,35 +116,151 @@ func NewMin[D constraints.Ordered, V any]() DistQueueMin[D, V] {
 
 func (d *DistQueueMax[D, V]) Insert(dist D, v V) {
 	*d = append(*d, Element[D, V]{dist, v})
-	slices.SortFunc(*d, maxSort)
+	up(*d, len(*d)-1, farther)
+}
+
+// Pop removes and returns the farthest element
+func (d *DistQueueMax[D, V]) Pop() (D, V) {
+	out, h := pop(*d, farther)
+	*d = h
+	return out.Dist, out.Value
+}
+
+// Peek returns the farthest element without removing it
+func (d *DistQueueMax[D, V]) Peek() (D, V) {
+	return (*d)[0].Dist, (*d)[0].Value
 }
 
 func (d *DistQueueMin[D, V]) Insert(dist D, v V) {
 	*d = append(*d, Element[D, V]{dist, v})
-	slices.SortFunc(*d, minSort)
+	up(*d, len(*d)-1, nearer)
 }
 
+// Pop removes and returns the nearest element
+func (d *DistQueueMin[D, V]) Pop() (D, V) {
+	out, h := pop(*d, nearer)
+	*d = h
+	return out.Dist, out.Value
+}
+
+// Peek returns the nearest element without removing it
+func (d *DistQueueMin[D, V]) Peek() (D, V) {
+	return (*d)[0].Dist, (*d)[0].Value
+}
+
+// Insert adds an element if the queue has room, or if it is nearer than the
+// farthest element kept, which is then dropped
 func (d *DistQueueMinCapped[D, V]) Insert(dist D, v V) {
 	if len(*d) == cap(*d) {
-		if dist > (*d)[len(*d)-1].Dist {
+		if len(*d) == 0 || dist > (*d)[0].Dist {
 			return
 		}
-		(*d) = (*d)[:len((*d))-1]
+		(*d)[0] = Element[D, V]{dist, v}
+		down(*d, 0, farther)
+		return
 	}
 	*d = append(*d, Element[D, V]{dist, v})
-	slices.SortFunc(*d, minSort)
+	up(*d, len(*d)-1, farther)
 }
 
+// Max returns the distance of the farthest element kept
 func (d *DistQueueMinCapped[D, V]) Max() D {
-	return (*d)[len(*d)-1].Dist
+	return (*d)[0].Dist
 }
 
 func (d *DistQueueMinCapped[D, V]) Filled() bool {
 	return len(*d) == cap(*d)
 }
 
-func (d *DistQueueMin[D, V]) Pop() (D, V) {
-	out := (*d)[0]
-	(*d) = (*d)[1:]
-	return out.Dist, out.Value
+// Ascending returns the elements nearest first
+func (d *DistQueueMax[D, V]) Ascending() []Element[D, V] {
+	return sorted(*d, minSort)
+}
+
+// Descending returns the elements farthest first
+func (d *DistQueueMax[D, V]) Descending() []Element[D, V] {
+	return sorted(*d, maxSort)
+}
+
+// Sorted returns the elements nearest first, like Ascending
+func (d *DistQueueMax[D, V]) Sorted() []Element[D, V] {
+	return d.Ascending()
+}
+
+// Ascending returns the elements nearest first
+func (d *DistQueueMin[D, V]) Ascending() []Element[D, V] {
+	return sorted(*d, minSort)
+}
+
+// Descending returns the elements farthest first
+func (d *DistQueueMin[D, V]) Descending() []Element[D, V] {
+	return sorted(*d, maxSort)
+}
+
+// Sorted returns the elements nearest first, like Ascending
+func (d *DistQueueMin[D, V]) Sorted() []Element[D, V] {
+	return d.Ascending()
+}
+
+// Ascending returns the elements nearest first
+func (d *DistQueueMinCapped[D, V]) Ascending() []Element[D, V] {
+	return sorted(*d, minSort)
+}
+
+// Descending returns the elements farthest first
+func (d *DistQueueMinCapped[D, V]) Descending() []Element[D, V] {
+	return sorted(*d, maxSort)
+}
+
+// Sorted returns the elements nearest first, like Ascending
+func (d *DistQueueMinCapped[D, V]) Sorted() []Element[D, V] {
+	return d.Ascending()
+}
+
+//
+
+// heapify puts a slice into heap order in O(n)
+func heapify[D constraints.Ordered, V any](h []Element[D, V], before func(a, b D) bool) {
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		down(h, i, before)
+	}
+}
+
+// MinFromSlice builds a queue holding the elements of s in O(n). The queue
+// takes over s, which is reordered
+func MinFromSlice[D constraints.Ordered, V any](s []Element[D, V]) DistQueueMin[D, V] {
+	heapify(s, nearer)
+	return DistQueueMin[D, V](s)
+}
+
+// MaxFromSlice builds a queue holding the elements of s in O(n). The queue
+// takes over s, which is reordered
+func MaxFromSlice[D constraints.Ordered, V any](s []Element[D, V]) DistQueueMax[D, V] {
+	heapify(s, farther)
+	return DistQueueMax[D, V](s)
+}
+
+// MinCappedFromSlice builds a queue of capacity c holding the c nearest
+// elements of s. If s fits, this takes O(n), otherwise O(n log c). s is
+// not changed
+func MinCappedFromSlice[D constraints.Ordered, V any](c int, s []Element[D, V]) DistQueueMinCapped[D, V] {
+	out := make(DistQueueMinCapped[D, V], min(c, len(s)), c)
+	copy(out, s)
+	heapify(out, farther)
+	for _, e := range s[len(out):] {
+		out.Insert(e.Dist, e.Value)
+	}
+	return out
+}
+
+// MergeMinCapped combines queues, such as the results of searching several
+// shards, into a queue holding the k nearest of all of their elements
+func MergeMinCapped[D constraints.Ordered, V any](k int, queues ...DistQueueMinCapped[D, V]) DistQueueMinCapped[D, V] {
+	out := NewMinCapped[D, V](k)
+	for _, q := range queues {
+		for _, e := range q {
+			out.Insert(e.Dist, e.Value)
+		}
+	}
+	return out
 }
@@ -0,0 +1,306 @@
+package hnswindex
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"github.com/bmeg/hnsw-index/distqueue"
+	"github.com/cockroachdb/pebble"
+)
+
+// default for DB.SetExactScanFraction
+const defaultExactScanFraction = 0.05
+
+// SetExactScanFraction sets the fraction of a graph at or below which
+// SearchWhere skips the graph walk, and scans the vectors matching its filter
+// directly. It applies to every graph of the DB, including ones loaded in
+// memory. The default is 0.05
+func (db *DB) SetExactScanFraction(f float64) {
+	db.exactScan.Store(&f)
+}
+
+func (db *DB) exactScanFraction() float64 {
+	if f := db.exactScan.Load(); f != nil {
+		return *f
+	}
+	return defaultExactScanFraction
+}
+
+// Filter is a declarative condition on payload fields, resolved using the
+// payload index before the search starts
+type Filter interface {
+	resolve(graph *Graph) (*idSet, error)
+}
+
+type eqFilter struct {
+	field string
+	value any
+}
+
+type inFilter struct {
+	field  string
+	values []any
+}
+
+type betweenFilter struct {
+	field  string
+	lo, hi float64
+}
+
+type andFilter []Filter
+type orFilter []Filter
+
+// Eq matches vectors where field equals value. Strings, bools and numbers
+// are supported. For array fields, any element may match
+func Eq(field string, value any) Filter {
+	return eqFilter{field, value}
+}
+
+// In matches vectors where field equals one of values
+func In(field string, values ...any) Filter {
+	return inFilter{field, values}
+}
+
+// Between matches vectors where the numeric field is in the inclusive
+// range lo to hi
+func Between(field string, lo, hi float64) Filter {
+	return betweenFilter{field, lo, hi}
+}
+
+// And matches vectors that pass all of filters
+func And(filters ...Filter) Filter {
+	return andFilter(filters)
+}
+
+// Or matches vectors that pass any of filters
+func Or(filters ...Filter) Filter {
+	return orFilter(filters)
+}
+
+// SearchWhere finds the K nearest vectors to vec whose payloads pass filter.
+// The filter is turned into a set of allowed ids up front. If it matches only
+// a small fraction of the graph, the matching vectors are scanned exactly,
+// otherwise the graph is searched with non-matching nodes used only as hops.
+// A nil filter matches every vector, like Search
+func (graph *Graph) SearchWhere(vec []float32, K int, ef int, filter Filter) ([]SearchResult, error) {
+	if filter == nil {
+		return graph.Search(vec, K, ef)
+	}
+	ef, err := graph.checkQuery(vec, K, ef)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := filter.resolve(graph)
+	if err != nil {
+		return nil, err
+	}
+	count := allowed.count()
+	if count == 0 {
+		return []SearchResult{}, nil
+	}
+	size, err := graph.estimatedSize()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := graph.tombstoneFilter()
+	if err != nil {
+		return nil, err
+	}
+	disk := graph.db
+	if graph.memory != nil {
+		disk = graph.memory.disk
+	}
+	if count <= ef || float64(count) <= disk.exactScanFraction()*float64(size) {
+		return graph.exactSearch(vec, K, allowed, deleted)
+	}
+	accept := func(id uint64) (bool, error) {
+		if !allowed.has(id) {
+			return false, nil
+		}
+		return acceptNode(deleted, id)
+	}
+	return graph.search(vec, K, ef, accept)
+}
+
+// exactSearch calculates the distance to every allowed vector
+func (graph *Graph) exactSearch(vec []float32, K int, allowed *idSet, accept func(uint64) (bool, error)) ([]SearchResult, error) {
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	w := distqueue.NewMinCapped[float32, uint64](K)
+	var scanErr error
+	allowed.each(func(id uint64) bool {
+		if ok, err := acceptNode(accept, id); err != nil {
+			scanErr = err
+			return false
+		} else if !ok {
+			return true
+		}
+		key := VectorKeyEncode(graph.graphid, id)
+		if iter.SeekGE(key) && bytes.Equal(iter.Key(), key) {
+			w.Insert(graph.metric.Distance(vec, VectorValueParse(iter.Value())), id)
+		}
+		return true
+	})
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	found := w.Ascending()
+	ids := make([]uint64, len(found))
+	dists := make([]float32, len(found))
+	for i := range found {
+		ids[i] = found[i].Value
+		dists[i] = found[i].Dist
+	}
+	return graph.searchResults(ids, dists, K)
+}
+
+func (f eqFilter) resolve(graph *Graph) (*idSet, error) {
+	prefix, ok := IndexValuePrefix(graph.graphid, f.field, f.value)
+	if !ok {
+		return nil, fmt.Errorf("field %s: unsupported filter value type %T", f.field, f.value)
+	}
+	return graph.scanIndex(prefix, PrefixEnd(prefix))
+}
+
+func (f inFilter) resolve(graph *Graph) (*idSet, error) {
+	out := &idSet{}
+	for _, v := range f.values {
+		s, err := eqFilter{f.field, v}.resolve(graph)
+		if err != nil {
+			return nil, err
+		}
+		out.union(s)
+	}
+	return out, nil
+}
+
+func (f betweenFilter) resolve(graph *Graph) (*idSet, error) {
+	if f.lo > f.hi {
+		return &idSet{}, nil
+	}
+	start, _ := IndexValuePrefix(graph.graphid, f.field, f.lo)
+	end, _ := IndexValuePrefix(graph.graphid, f.field, f.hi)
+	return graph.scanIndex(start, PrefixEnd(end))
+}
+
+func (f andFilter) resolve(graph *Graph) (*idSet, error) {
+	if len(f) == 0 {
+		return nil, fmt.Errorf("empty And filter")
+	}
+	out, err := f[0].resolve(graph)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range f[1:] {
+		s, err := i.resolve(graph)
+		if err != nil {
+			return nil, err
+		}
+		out.intersect(s)
+	}
+	return out, nil
+}
+
+func (f orFilter) resolve(graph *Graph) (*idSet, error) {
+	out := &idSet{}
+	for _, i := range f {
+		s, err := i.resolve(graph)
+		if err != nil {
+			return nil, err
+		}
+		out.union(s)
+	}
+	return out, nil
+}
+
+func (graph *Graph) scanIndex(start, end []byte) (*idSet, error) {
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: start, UpperBound: end})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	out := &idSet{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		out.add(IndexKeyParseEntry(iter.Key()))
+	}
+	return out, nil
+}
+
+// estimatedSize returns the number of vectors in the graph. The vectors are
+// counted once, and then kept up to date by inserts and deletes made through
+// this Graph
+func (graph *Graph) estimatedSize() (int64, error) {
+	var err error
+	graph.sizeOnce.Do(func() {
+		var count uint64
+		count, err = graph.db.countKeys(NameRevGraphPrefix(graph.graphid))
+		graph.size.Store(int64(count))
+	})
+	return graph.size.Load(), err
+}
+
+// idSet is a bitmap of node ids
+type idSet struct {
+	words []uint64
+}
+
+func (s *idSet) add(id uint64) {
+	w := int(id / 64)
+	if w >= len(s.words) {
+		s.words = append(s.words, make([]uint64, w-len(s.words)+1)...)
+	}
+	s.words[w] |= 1 << (id % 64)
+}
+
+func (s *idSet) has(id uint64) bool {
+	w := id / 64
+	if w >= uint64(len(s.words)) {
+		return false
+	}
+	return s.words[w]&(1<<(id%64)) != 0
+}
+
+func (s *idSet) count() int {
+	c := 0
+	for _, w := range s.words {
+		c += bits.OnesCount64(w)
+	}
+	return c
+}
+
+func (s *idSet) union(o *idSet) {
+	if len(o.words) > len(s.words) {
+		s.words = append(s.words, make([]uint64, len(o.words)-len(s.words))...)
+	}
+	for i, w := range o.words {
+		s.words[i] |= w
+	}
+}
+
+func (s *idSet) intersect(o *idSet) {
+	if len(o.words) < len(s.words) {
+		s.words = s.words[:len(o.words)]
+	}
+	for i := range s.words {
+		s.words[i] &= o.words[i]
+	}
+}
+
+// each calls fn for every id in ascending order, until fn returns false
+func (s *idSet) each(fn func(uint64) bool) {
+	for i, w := range s.words {
+		for w != 0 {
+			b := bits.TrailingZeros64(w)
+			if !fn(uint64(i)*64 + uint64(b)) {
+				return
+			}
+			w &= w - 1
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package hnswindex
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// number of ids reserved in the counter with each write
+const idRangeSize = 1024
+
+// idAllocator hands out node ids from a range reserved in the persisted
+// counter, so the counter is only written once per idRangeSize inserts.
+// Ids left in the range when the DB is closed are skipped
+type idAllocator struct {
+	mutex sync.Mutex
+	next  uint64
+	limit uint64
+}
+
+func (a *idAllocator) allocate(db *DB, graphId uint32) (uint64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.next == a.limit {
+		start, err := db.reserveIDs(graphId, idRangeSize)
+		if err != nil {
+			return 0, err
+		}
+		a.next, a.limit = start, start+idRangeSize
+	}
+	id := a.next
+	a.next++
+	return id, nil
+}
+
+// reserveIDs moves the id counter of a graph forward by count, returning
+// the first id of the reserved range. Ids start at 1
+func (db *DB) reserveIDs(graphId uint32, count uint64) (uint64, error) {
+	key := CounterKeyEncode(graphId)
+	var start uint64
+	val, closer, err := db.db.Get(key)
+	if err == nil {
+		start = CounterValueParse(val)
+		closer.Close()
+	} else if err == pebble.ErrNotFound {
+		maxID, err := db.maxVectorID(graphId)
+		if err != nil {
+			return 0, err
+		}
+		start = maxID + 1
+	} else {
+		return 0, err
+	}
+	//synced, so ids can't be handed out twice after a crash
+	if err := db.db.Set(key, CounterValueEncode(start+count), pebble.Sync); err != nil {
+		return 0, err
+	}
+	return start, nil
+}
@@ -2,9 +2,13 @@ package hnswindex
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bmeg/hnsw-index/distqueue"
 	"github.com/cockroachdb/pebble"
@@ -16,143 +20,623 @@ type Node struct {
 }
 
 type Graph struct {
-	graphid   uint32
-	name      string
-	m         uint8   //number of layers
-	efCount   int     //number of friends in KNN construction
-	dim       int     //dimensions of stored vectors
-	levelMult float64 //multipler to calculate random layer
-	db        *DB
+	graphid        uint32
+	name           string
+	dim            int     //dimensions of stored vectors
+	maxM           int     //max number of friends per node in layers above 0
+	maxM0          int     //max number of friends per node in layer 0
+	efConstruction int     //size of the candidate list used while inserting
+	levelMult      float64 //multipler to calculate random layer
+	metric         Metric
+	db             *DB
+	reader         pebble.Reader //the DB, or an indexed batch for writes in progress
+	locks          *graphLocks
+	cache          *nodeCache
+	memory         *memGraph //set if the graph was loaded with LoadGraphInMemory
+	sizeOnce       sync.Once
+	size           atomic.Int64 //estimated number of vectors, see estimatedSize
+
+	extendCandidates      bool //see GraphConfig
+	keepPrunedConnections bool
 }
 
-type batchInsert struct {
-	key, value []byte
+// withReader returns a copy of the graph that reads through r, usually an
+// indexed batch, so writes that are not committed yet can be seen
+func (graph *Graph) withReader(r pebble.Reader) *Graph {
+	return &Graph{
+		graphid:               graph.graphid,
+		name:                  graph.name,
+		dim:                   graph.dim,
+		maxM:                  graph.maxM,
+		maxM0:                 graph.maxM0,
+		efConstruction:        graph.efConstruction,
+		levelMult:             graph.levelMult,
+		metric:                graph.metric,
+		db:                    graph.db,
+		reader:                r,
+		locks:                 graph.locks,
+		cache:                 graph.cache,
+		memory:                graph.memory,
+		extendCandidates:      graph.extendCandidates,
+		keepPrunedConnections: graph.keepPrunedConnections,
+	}
 }
 
+// Insert adds a named vector to the graph. If the name is already
+// present, including nodes marked deleted that have not been vacuumed,
+// ErrDuplicateName is returned; use Upsert to replace it. Insert is safe
+// to call from many goroutines at once, including alongside searches
 func (graph *Graph) Insert(name []byte, vec []float32) error {
+	return graph.InsertWithPayload(name, vec, nil)
+}
 
-	layer := uint8(math.Floor(-math.Log(rand.Float64() * graph.levelMult)))
-
-	//fmt.Printf("Insert Layer: %d\n", layer)
+// InsertWithPayload adds a named vector to the graph, storing payload
+// alongside it. The payload is returned with search results
+func (graph *Graph) InsertWithPayload(name []byte, vec []float32, payload Payload) error {
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	return graph.insert(name, vec, payload, graph.randomLevel())
+}
 
-	eLayer, ep, eVec, err := graph.getEntryPoint()
+// insert adds a node, linking it into the layers from level down
+func (graph *Graph) insert(name []byte, vec []float32, payload Payload, level uint8) error {
+	if err := graph.checkLive(); err != nil {
+		return err
+	}
+	if err := graph.checkItem(vec, payload); err != nil {
+		return err
+	}
+	id, release, err := graph.reserveName(name)
 	if err != nil {
 		return err
 	}
+	defer release()
+	return graph.insertReserved(id, name, vec, payload, level)
+}
 
-	if ep == 0 {
-		//no entrypoint, so this node becomes it
-		nid, err := graph.db.insertGraphVector(graph.graphid, name, vec)
+// insertReserved adds a node under a new id, while its name is held by
+// reserveName or claimName
+func (graph *Graph) insertReserved(id uint64, name []byte, vec []float32, payload Payload, level uint8) error {
+	//the name, vector, payload and links are all written in one batch,
+	//indexed so the new vector can be read back while pruning links
+	batch := graph.db.db.NewIndexedBatch()
+	defer batch.Close()
+	if err := graph.withReader(batch).insertNode(batch, id, name, vec, payload); err != nil {
+		return err
+	}
+	if err := graph.insertLinks(batch, id, vec, level); err != nil {
+		return err
+	}
+	graph.size.Add(1)
+	return nil
+}
+
+// checkItem validates a vector and payload before anything is written
+func (graph *Graph) checkItem(vec []float32, payload Payload) error {
+	if len(vec) != graph.dim {
+		return fmt.Errorf("vector has %d dimensions, graph %s has %d", len(vec), graph.name, graph.dim)
+	}
+	if payload != nil {
+		if _, err := PayloadValueEncode(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkQuery validates the arguments of a search, and returns the size of
+// the candidate list to use, which is at least K
+func (graph *Graph) checkQuery(vec []float32, K int, ef int) (int, error) {
+	if len(vec) != graph.dim {
+		return 0, fmt.Errorf("query has %d dimensions, graph %s has %d", len(vec), graph.name, graph.dim)
+	}
+	if K <= 0 || ef <= 0 {
+		return 0, fmt.Errorf("search needs K and ef above 0, got K=%d ef=%d", K, ef)
+	}
+	return max(ef, K), nil
+}
+
+// insertNode adds the name, vector and payload of a new node to a batch
+func (graph *Graph) insertNode(batch *pebble.Batch, id uint64, name []byte, vec []float32, payload Payload) error {
+	if err := insertGraphVector(batch, graph.graphid, name, id, vec); err != nil {
+		return err
+	}
+	if payload != nil {
+		return graph.setPayload(batch, id, payload)
+	}
+	return nil
+}
+
+// Upsert adds a named vector to the graph, or if the name is already
+// present, replaces its vector and rebuilds its links. A tombstone left
+// by MarkDeleted is cleared. An existing payload is kept
+func (graph *Graph) Upsert(name []byte, vec []float32) error {
+	return graph.upsert(name, vec, nil, false)
+}
+
+// UpsertWithPayload works like Upsert, but also replaces the payload.
+// A nil payload removes the stored one
+func (graph *Graph) UpsertWithPayload(name []byte, vec []float32, payload Payload) error {
+	return graph.upsert(name, vec, payload, true)
+}
+
+// reserveName checks that name is not stored or being inserted, and
+// allocates an id for it. Other inserts of the name fail with
+// ErrDuplicateName until release is called, which must be done after the
+// name is committed
+func (graph *Graph) reserveName(name []byte) (uint64, func(), error) {
+	graph.locks.names.Lock()
+	defer graph.locks.names.Unlock()
+	if _, ok := graph.locks.pending[string(name)]; ok {
+		return 0, nil, fmt.Errorf("%w: %s", ErrDuplicateName, name)
+	}
+	if _, err := graph.db.getVectorID(graph.graphid, name); err == nil {
+		return 0, nil, fmt.Errorf("%w: %s", ErrDuplicateName, name)
+	} else if !errors.Is(err, ErrNameNotFound) {
+		return 0, nil, err
+	}
+	id, err := graph.newNodeID()
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, graph.locks.holdName(string(name)), nil
+}
+
+// claimName reserves name against other writers, like reserveName, but
+// also accepts a stored name, returning its id with stored set. If another
+// writer holds the name, it waits for it to be released
+func (graph *Graph) claimName(name []byte) (uint64, bool, func(), error) {
+	for {
+		graph.locks.names.Lock()
+		if done, ok := graph.locks.pending[string(name)]; ok {
+			graph.locks.names.Unlock()
+			<-done
+			continue
+		}
+		id, err := graph.db.getVectorID(graph.graphid, name)
+		if err != nil && !errors.Is(err, ErrNameNotFound) {
+			graph.locks.names.Unlock()
+			return 0, false, nil, err
+		}
+		release := graph.locks.holdName(string(name))
+		graph.locks.names.Unlock()
+		return id, err == nil, release, nil
+	}
+}
+
+// newNodeID allocates an id for a new node
+func (graph *Graph) newNodeID() (uint64, error) {
+	id, err := graph.db.newVectorID(graph.graphid)
+	if err == nil && id == 0 {
+		err = fmt.Errorf("invalid node id (0) generated")
+	}
+	return id, err
+}
+
+func (graph *Graph) upsert(name []byte, vec []float32, payload Payload, replacePayload bool) error {
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	if err := graph.checkLive(); err != nil {
+		return err
+	}
+	if err := graph.checkItem(vec, payload); err != nil {
+		return err
+	}
+	for {
+		//the name is held until the new vector is committed, so writers of
+		//the same name run one at a time
+		id, stored, release, err := graph.claimName(name)
 		if err != nil {
 			return err
 		}
-		if nid != 1 {
-			return fmt.Errorf("entrypoint init error")
+		if !stored {
+			id, err = graph.newNodeID()
+			if err == nil {
+				err = graph.insertReserved(id, name, vec, payload, graph.randomLevel())
+			}
+			release()
+			return err
+		}
+		replaced, err := graph.replaceNode(name, id, vec, payload, replacePayload)
+		release()
+		if err != nil || replaced {
+			return err
+		}
+		//deleted before it could be locked, so insert it again
+	}
+}
+
+// replaceNode swaps the vector of a stored node and rebuilds its links. The
+// old edges are removed, the nodes that linked to it repaired, and the new
+// links added in one batch, committed while the node, its old neighbors and
+// its new friends are all locked. Returns false, without writing anything,
+// if the name was deleted before the node was locked
+func (graph *Graph) replaceNode(name []byte, id uint64, vec []float32, payload Payload, replacePayload bool) (bool, error) {
+	level := graph.randomLevel()
+	var friends []uint64
+	for {
+		unlock, locked, err := graph.lockNeighborhood(id, friends...)
+		if err != nil {
+			return false, err
+		}
+		if _, err := graph.db.getVectorID(graph.graphid, name); err != nil {
+			unlock()
+			if errors.Is(err, ErrNameNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		missing, err := graph.relink(id, vec, payload, replacePayload, level, locked)
+		unlock()
+		if err != nil || len(missing) == 0 {
+			return err == nil, err
+		}
+		//the new friends were not locked, so start again with them included
+		friends = append(friends, missing...)
+	}
+}
+
+// relink replaces the vector of a node, removing its edges, repairing the
+// nodes that linked to it and linking it again at level, and commits it all
+// in one batch. The node and its neighbors must be locked, their ids are
+// in locked. If the new friends of the node are not covered by the locks,
+// nothing is committed and their ids are returned
+func (graph *Graph) relink(id uint64, vec []float32, payload Payload, replacePayload bool, level uint8, locked []uint64) ([]uint64, error) {
+	batch := graph.db.db.NewIndexedBatch()
+	defer batch.Close()
+	view := graph.withReader(batch)
+	if _, err := view.unlinkNode(batch, id, nil); err != nil {
+		return nil, err
+	}
+	batch.Set(VectorKeyEncode(graph.graphid, id), VectorValueEncode(vec), nil)
+	batch.Delete(TombstoneKeyEncode(graph.graphid, id), nil)
+	if replacePayload {
+		if err := view.setPayload(batch, id, payload); err != nil {
+			return nil, err
 		}
-		//fmt.Printf("entrypoint id: %d\n", nid)
-		return nil
 	}
 
-	id, err := graph.db.insertGraphVector(graph.graphid, name, vec)
+	//no other writer can make the locked node the entry point. If it is
+	//already, it is moved off the node, and the entry lock is held until
+	//the batch is committed, so other inserts can't raise it meanwhile
+	graph.locks.entry.Lock()
+	ep, eLevel, err := graph.getEntryID()
+	ownsEntry := err == nil && ep == id
+	if ownsEntry {
+		defer graph.locks.entry.Unlock()
+		newEp, newLevel, err := graph.findEntryPoint(id, eLevel)
+		if err != nil {
+			return nil, err
+		}
+		if newEp == 0 {
+			//only node in the graph, so it becomes the entry point again
+			batch.Delete(EntryKeyEncode(graph.graphid), nil)
+		} else {
+			batch.Set(EntryKeyEncode(graph.graphid), EntryValueEncode(newEp, newLevel), nil)
+		}
+	} else {
+		graph.locks.entry.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan, err := view.planLinks(id, level, vec)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if id == 0 {
-		return fmt.Errorf("invalid node id (0) generated")
+	friends := []uint64{}
+	for _, neighbors := range plan.layers {
+		for _, n := range neighbors {
+			friends = append(friends, n.Value)
+		}
 	}
+	if !graph.locks.covers(locked, friends) {
+		return friends, nil
+	}
+	if ownsEntry {
+		if err := view.writeEdges(batch, plan); err != nil {
+			return nil, err
+		}
+		if err := view.raiseEntry(batch, plan); err != nil {
+			return nil, err
+		}
+	} else if err := view.writeLinks(batch, plan); err != nil {
+		return nil, err
+	}
+	return nil, graph.commit(batch)
+}
 
-	eDist := Euclidean(vec, eVec)
+// linkPlan is the result of searching the graph for the friends of a new
+// node, before any links are written
+type linkPlan struct {
+	id     uint64
+	level  uint8
+	eLevel uint8 //level of the entry point when the search started
+	first  bool  //the graph was empty, so the node becomes the entry point
+	layers [][]distqueue.Element[float32, uint64]
+}
 
-	//move down the layers to the target layer, attempting to get close along the way
-	for l := eLayer; l > layer+1; l-- {
-		changed := true
-		for changed {
-			changed = false
-			lf, err := graph.getLayerFriends(eLayer, ep, graph.efCount)
-			if err != nil {
-				return err
-			}
-			fds, err := graph.getDistances(vec, lf)
-			if err != nil {
+// insertLinks connects a vector into the graph layers, from level down to
+// layer 0, and commits the batch. The layers are
+// searched without holding any locks, then the new node and the friends it
+// links to are locked while their neighbor lists are updated. The batch
+// must be indexed, and hold the vector of the node
+func (graph *Graph) insertLinks(batch *pebble.Batch, id uint64, vec []float32, level uint8) error {
+	view := graph.withReader(batch)
+	for {
+		plan, err := view.planLinks(id, level, vec)
+		if err != nil {
+			return err
+		}
+		if plan.first {
+			done, err := graph.commitFirstEntry(batch, id, level)
+			if done || err != nil {
 				return err
 			}
-			for i := range lf {
-				if fds[i] < eDist {
-					ep = lf[i]
-					eDist = fds[i]
-					changed = true
-				}
+			//another node became the entry point first
+			continue
+		}
+
+		lockIds := []uint64{id}
+		for _, neighbors := range plan.layers {
+			for _, n := range neighbors {
+				lockIds = append(lockIds, n.Value)
 			}
 		}
+		unlock := graph.locks.lockNodes(lockIds)
+		defer unlock()
+		if err := view.writeLinks(batch, plan); err != nil {
+			return err
+		}
+		return graph.commit(batch)
+	}
+}
+
+// planLinks searches the layers for the friends of a new node at level
+func (graph *Graph) planLinks(id uint64, level uint8, vec []float32) (*linkPlan, error) {
+
+	//fmt.Printf("Insert Layer: %d\n", level)
+
+	plan := &linkPlan{id: id, level: level}
+	eLevel, ep, eVec, err := graph.getEntryPoint()
+	if err != nil {
+		return nil, err
+	}
+	if ep == 0 {
+		//no entrypoint, so this node becomes it
+		plan.first = true
+		return plan, nil
+	}
+	plan.eLevel = eLevel
+
+	eDist := graph.metric.Distance(vec, eVec)
+
+	//move down the layers to the target layer, attempting to get close along the way
+	for l := int(eLevel); l > int(level); l-- {
+		ep, eDist, err = graph.greedyClosest(vec, uint8(l), ep, eDist)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	inserts := make([]*batchInsert, 0, 100)
-	for l := int(layer); l >= 0; l-- {
-		res, resDist, err := graph.layerSearch(vec, uint8(l), ep, graph.efCount)
+	top := min(int(level), int(eLevel))
+	plan.layers = make([][]distqueue.Element[float32, uint64], top+1)
+	for l := top; l >= 0; l-- {
+		res, resDist, err := graph.layerSearch(vec, uint8(l), ep, graph.efConstruction, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		//fmt.Printf("Layer Search %#v %#v\n", res, resDist)
-		//record links for current layer
+		cands := make([]distqueue.Element[float32, uint64], len(res))
 		for i := range res {
-			//fmt.Printf("Inserting link: %d %d %d %f\n", l, id, res[i], resDist[i])
-			kS, vS := graph.genInsertLink(graph.graphid, uint8(l), id, res[i], resDist[i])
-			kD, vD := graph.genInsertLink(graph.graphid, uint8(l), res[i], id, resDist[i])
-			inserts = append(inserts, &batchInsert{key: kS, value: vS}, &batchInsert{key: kD, value: vD})
+			cands[i] = distqueue.Element[float32, uint64]{Dist: resDist[i], Value: res[i]}
+		}
+		plan.layers[l], err = graph.selectNeighbors(id, vec, cands, graph.maxM, uint8(l), nil)
+		if err != nil {
+			return nil, err
 		}
+		//closest node found is the entry point for the next layer down
+		if len(res) > 0 {
+			ep = res[0]
+		}
+	}
+	return plan, nil
+}
+
+// writeLinks adds the level, links and any entry point change of a planned
+// insert to the batch. The node and its new friends must be locked
+func (graph *Graph) writeLinks(batch *pebble.Batch, plan *linkPlan) error {
+	if err := graph.writeEdges(batch, plan); err != nil {
+		return err
+	}
+	if plan.first || plan.level > plan.eLevel {
+		graph.locks.entry.Lock()
+		defer graph.locks.entry.Unlock()
+		return graph.raiseEntry(batch, plan)
 	}
+	return nil
+}
 
-	batch := graph.db.db.NewBatch()
-	for _, i := range inserts {
-		batch.Set(i.key, i.value, nil)
+// writeEdges adds the level and links of a planned insert to the batch
+func (graph *Graph) writeEdges(batch *pebble.Batch, plan *linkPlan) error {
+	id := plan.id
+	batch.Set(LevelKeyEncode(graph.graphid, id), []byte{plan.level}, nil)
+
+	//record links for each layer, pruning the friends lists that overflow
+	for l, neighbors := range plan.layers {
+		for _, n := range neighbors {
+			//fmt.Printf("Inserting link: %d %d %d %f\n", l, id, n.Value, n.Dist)
+			graph.setLink(batch, uint8(l), id, n.Value, n.Dist)
+			if err := graph.addLink(batch, uint8(l), n.Value, id, n.Dist); err != nil {
+				return err
+			}
+		}
 	}
-	batch.Commit(nil)
-	batch.Close()
+	return nil
+}
 
+// raiseEntry makes a planned node the entry point, if the graph has none or
+// the node is above it. The entry point may have been raised by another
+// insert since the plan was made. Caller must hold locks.entry
+func (graph *Graph) raiseEntry(batch *pebble.Batch, plan *linkPlan) error {
+	if ep, cur, err := graph.getEntryID(); err != nil {
+		return err
+	} else if ep == 0 || plan.level > cur {
+		batch.Set(EntryKeyEncode(graph.graphid), EntryValueEncode(plan.id, plan.level), nil)
+	}
 	return nil
 }
 
-func (graph *Graph) Search(vec []float32, K int, ef int) ([][]byte, error) {
-	eLevel, ePoint, eVec, err := graph.getEntryPoint()
+// commitFirstEntry makes a node the entry point of an empty graph, and
+// commits the batch. Returns false, without committing, if the graph
+// already has an entry point
+func (graph *Graph) commitFirstEntry(batch *pebble.Batch, id uint64, level uint8) (bool, error) {
+	graph.locks.entry.Lock()
+	defer graph.locks.entry.Unlock()
+	if ep, _, err := graph.getEntryID(); err != nil || ep != 0 {
+		return false, err
+	}
+	batch.Set(LevelKeyEncode(graph.graphid, id), []byte{level}, nil)
+	batch.Set(EntryKeyEncode(graph.graphid), EntryValueEncode(id, level), nil)
+	return true, graph.commit(batch)
+}
+
+// randomLevel picks the top layer for a new node, from an exponentially
+// decaying distribution, so each layer has about 1/M of the nodes of the
+// layer below it
+func (graph *Graph) randomLevel() uint8 {
+	return graph.levelFor(rand.Float64())
+}
+
+// levelFor maps a uniform random number in [0, 1) to a level
+func (graph *Graph) levelFor(r float64) uint8 {
+	l := math.Floor(-math.Log(1-r) * graph.levelMult)
+	if l > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(l)
+}
+
+// greedyClosest walks a layer from ep, moving to any friend closer to vec,
+// until no closer node can be found
+func (graph *Graph) greedyClosest(vec []float32, layer uint8, ep uint64, eDist float32) (uint64, float32, error) {
+	changed := true
+	for changed {
+		changed = false
+		friends, err := graph.getLayerFriends(layer, ep)
+		if err != nil {
+			return 0, 0, err
+		}
+		friends, fDists, err := graph.getDistances(vec, friends)
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := range friends {
+			if fDists[i] < eDist {
+				ep = friends[i]
+				eDist = fDists[i]
+				changed = true
+			}
+		}
+	}
+	return ep, eDist, nil
+}
+
+// SearchResult is a single match from Search. The stored vector is not
+// included, it can be fetched with GetVec using the ID
+type SearchResult struct {
+	Name     []byte
+	ID       uint64
+	Distance float32
+	Payload  Payload //nil if the vector was stored without a payload
+}
+
+// Search finds the K nearest vectors to vec, using a candidate list of
+// size ef, raised to K if it is smaller. Results are ordered by increasing
+// distance
+func (graph *Graph) Search(vec []float32, K int, ef int) ([]SearchResult, error) {
+	ef, err := graph.checkQuery(vec, K, ef)
 	if err != nil {
 		return nil, err
 	}
+	accept, err := graph.tombstoneFilter()
+	if err != nil {
+		return nil, err
+	}
+	return graph.search(vec, K, ef, accept)
+}
 
-	eDist := Euclidean(vec, eVec)
-	for l := int(eLevel); l >= 0; l-- {
-		changed := true
-		for changed {
-			changed = false
-			eFriends, err := graph.getLayerFriends(uint8(l), ePoint, graph.efCount)
-			if err != nil {
-				return nil, err
-			}
-			fDists, err := graph.getDistances(vec, eFriends)
-			if err != nil {
-				return nil, err
-			}
+// SearchFiltered finds the K nearest vectors to vec that pass filter. Nodes
+// rejected by the filter are still used to traverse the graph, so selective
+// filters do not cut the search off, but they are never returned
+func (graph *Graph) SearchFiltered(vec []float32, K int, ef int, filter func(id uint64, name []byte) bool) ([]SearchResult, error) {
+	if filter == nil {
+		return graph.Search(vec, K, ef)
+	}
+	ef, err := graph.checkQuery(vec, K, ef)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := graph.tombstoneFilter()
+	if err != nil {
+		return nil, err
+	}
+	accept := func(id uint64) (bool, error) {
+		if ok, err := acceptNode(deleted, id); err != nil || !ok {
+			return false, err
+		}
+		name, err := graph.db.getVectorName(graph.graphid, id)
+		if err == pebble.ErrNotFound {
+			//removed by a concurrent delete
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return filter(id, name), nil
+	}
+	return graph.search(vec, K, ef, accept)
+}
 
-			for i := range eFriends {
-				if fDists[i] < eDist {
-					ePoint = eFriends[i]
-					eDist = fDists[i]
-					changed = true
-				}
-			}
+func (graph *Graph) search(vec []float32, K int, ef int, accept func(uint64) (bool, error)) ([]SearchResult, error) {
+	eLevel, ePoint, eVec, err := graph.getEntryPoint()
+	if err != nil {
+		return nil, err
+	}
+	if ePoint == 0 {
+		//empty graph
+		return []SearchResult{}, nil
+	}
+
+	eDist := graph.metric.Distance(vec, eVec)
+	for l := int(eLevel); l > 0; l-- {
+		ePoint, eDist, err = graph.greedyClosest(vec, uint8(l), ePoint, eDist)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	ids, _, err := graph.layerSearch(vec, 0, ePoint, ef)
+	ids, dists, err := graph.layerSearch(vec, 0, ePoint, ef, accept)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([][]byte, 0, K)
+	return graph.searchResults(ids, dists, K)
+}
+
+// searchResults looks up the names and payloads of the first K ids
+func (graph *Graph) searchResults(ids []uint64, dists []float32, K int) ([]SearchResult, error) {
+	out := make([]SearchResult, 0, K)
 	for i := 0; i < K && i < len(ids); i++ {
 		n, err := graph.db.getVectorName(graph.graphid, ids[i])
-		if err == nil {
-			out = append(out, n)
+		if err != nil {
+			continue
 		}
+		p, err := graph.getPayload(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, SearchResult{Name: n, ID: ids[i], Distance: dists[i], Payload: p})
 	}
 	return out, nil
 }
@@ -161,7 +645,7 @@ func (graph *Graph) Search(vec []float32, K int, ef int) ([][]byte, error) {
 
 func (graph *Graph) FindLayerEntryPoint(layer uint8) (uint64, error) {
 	prefix := LayerPrefixEncode(graph.graphid, layer)
-	iter, err := graph.db.db.NewIter(&pebble.IterOptions{})
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{})
 	if err != nil {
 		return 0, err
 	}
@@ -176,7 +660,9 @@ func (graph *Graph) FindLayerEntryPoint(layer uint8) (uint64, error) {
 
 */
 
-func (graph *Graph) layerSearch(vec []float32, layer uint8, entryPoint uint64, K int) ([]uint64, []float32, error) {
+// layerSearch finds the K closest nodes to vec in a layer. If accept is not nil,
+// nodes it rejects are still used to traverse the layer, but are not returned
+func (graph *Graph) layerSearch(vec []float32, layer uint8, entryPoint uint64, K int, accept func(uint64) (bool, error)) ([]uint64, []float32, error) {
 
 	if entryPoint == 0 {
 		return []uint64{}, []float32{}, fmt.Errorf("invalid entryPoint id")
@@ -186,86 +672,198 @@ func (graph *Graph) layerSearch(vec []float32, layer uint8, entryPoint uint64, K
 	candidates := distqueue.NewMin[float32, uint64]()
 	w := distqueue.NewMinCapped[float32, uint64](K)
 
-	eVec, err := graph.GetVec(entryPoint)
+	eIds, eDists, err := graph.getDistances(vec, []uint64{entryPoint})
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(eIds) == 0 {
+		//entry point was removed while searching
+		return []uint64{}, []float32{}, nil
+	}
 
-	d := Euclidean(vec, eVec)
-	w.Insert(d, entryPoint)
+	d := eDists[0]
+	if ok, err := acceptNode(accept, entryPoint); err != nil {
+		return nil, nil, err
+	} else if ok {
+		w.Insert(d, entryPoint)
+	}
 	candidates.Insert(d, entryPoint)
 	visited[entryPoint] = true
 
 	for len(candidates) > 0 {
 		cdist, c := candidates.Pop()
-		fdist := w.Max()
-		if cdist > fdist {
+		if w.Filled() && cdist > w.Max() {
 			break
 		}
-		neighbors, err := graph.getLayerFriends(layer, c, graph.efCount)
+		neighbors, err := graph.getLayerFriends(layer, c)
 		if err != nil {
 			return nil, nil, err
 		}
-		ndists, err := graph.getDistances(vec, neighbors)
+		neighbors, ndists, err := graph.getDistances(vec, neighbors)
 		if err != nil {
 			return nil, nil, err
 		}
 		for n := range neighbors {
 			if _, ok := visited[neighbors[n]]; !ok {
-				if len(w) > 0 {
-					fdist := w.Max()
-					if (ndists[n] < fdist) || !w.Filled() {
+				if !w.Filled() || ndists[n] < w.Max() {
+					candidates.Insert(ndists[n], neighbors[n])
+					if ok, err := acceptNode(accept, neighbors[n]); err != nil {
+						return nil, nil, err
+					} else if ok {
 						w.Insert(ndists[n], neighbors[n])
-						candidates.Insert(ndists[n], neighbors[n])
 					}
 				}
 				visited[neighbors[n]] = true
 			}
 		}
 	}
-	outI := make([]uint64, len(w))
-	outD := make([]float32, len(w))
-	for i := range w {
-		outI[i] = w[i].Value
-		outD[i] = w[i].Dist
+	found := w.Ascending()
+	outI := make([]uint64, len(found))
+	outD := make([]float32, len(found))
+	for i := range found {
+		outI[i] = found[i].Value
+		outD[i] = found[i].Dist
+	}
+	return outI, outD, nil
+}
+
+func acceptNode(accept func(uint64) (bool, error), id uint64) (bool, error) {
+	if accept == nil {
+		return true, nil
+	}
+	return accept(id)
+}
 
+// getDistances calculates the distance from v to each of the nodes in n.
+// Nodes without a stored vector, because they were removed by a concurrent
+// delete, are left out of the returned ids
+func (graph *Graph) getDistances(v []float32, n []uint64) ([]uint64, []float32, error) {
+	outI := make([]uint64, 0, len(n))
+	outD := make([]float32, 0, len(n))
+	vecs, err := graph.readVectors(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range n {
+		if vecs[i] != nil {
+			outI = append(outI, n[i])
+			outD = append(outD, graph.metric.Distance(v, vecs[i]))
+		}
 	}
 	return outI, outD, nil
 }
 
-func (graph *Graph) getDistances(v []float32, n []uint64) ([]float32, error) {
-	out := make([]float32, len(n))
-	iter, err := graph.db.db.NewIter(&pebble.IterOptions{})
+// readVectors reads the stored vectors of ids, in the same order, from
+// memory or the node cache where possible. Nodes that have been removed get a nil vector.
+// Cached vectors are shared, and must not be changed
+func (graph *Graph) readVectors(ids []uint64) ([][]float32, error) {
+	var out [][]float32
+	cache := graph.readCache()
+	gens := make([]uint64, len(ids))
+	missed := 0
+	if m := graph.memoryView(); m != nil {
+		out = m.vectorsOf(ids)
+	} else {
+		out = make([][]float32, len(ids))
+	}
+	for i, id := range ids {
+		if out[i] != nil {
+			continue
+		}
+		if cache != nil {
+			e, gen := cache.get(nodeCacheKey{id: id, vector: true})
+			if e != nil {
+				out[i] = e.vec
+				continue
+			}
+			gens[i] = gen
+		}
+		missed++
+	}
+	if missed == 0 {
+		return out, nil
+	}
+	//the iterator is opened after the cache lookups, so it can't hold
+	//data older than their generations
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{})
 	if err != nil {
 		return nil, err
 	}
 	defer iter.Close()
-	for i := range n {
-		key := VectorKeyEncode(graph.graphid, n[i])
-		if iter.SeekGE(key) {
-			if bytes.Equal(iter.Key(), key) {
-				out[i] = Euclidean(v, VectorValueParse(iter.Value()))
+	for i, id := range ids {
+		if out[i] != nil {
+			continue
+		}
+		key := VectorKeyEncode(graph.graphid, id)
+		if iter.SeekGE(key) && bytes.Equal(iter.Key(), key) {
+			out[i] = VectorValueParse(iter.Value())
+			if cache != nil {
+				cache.put(&nodeCacheEntry{key: nodeCacheKey{id: id, vector: true}, vec: out[i]}, gens[i])
 			}
 		}
 	}
 	return out, nil
 }
 
+// GetVec returns the stored vector of a node
 func (graph *Graph) GetVec(id uint64) ([]float32, error) {
+	vec, err := graph.getVec(id)
+	if err != nil || (graph.readCache() == nil && graph.memoryView() == nil) {
+		return vec, err
+	}
+	//don't hand out the cached copy
+	return slices.Clone(vec), nil
+}
 
+// getVec returns the stored vector of a node, which may be shared with the
+// node cache
+func (graph *Graph) getVec(id uint64) ([]float32, error) {
+	if m := graph.memoryView(); m != nil {
+		if vec, ok := m.vector(id); ok {
+			return vec, nil
+		}
+	}
+	cache := graph.readCache()
+	var gen uint64
+	if cache != nil {
+		var e *nodeCacheEntry
+		if e, gen = cache.get(nodeCacheKey{id: id, vector: true}); e != nil {
+			return e.vec, nil
+		}
+	}
 	key := VectorKeyEncode(graph.graphid, id)
-	out, closer, err := graph.db.db.Get(key)
-	defer closer.Close()
+	out, closer, err := graph.reader.Get(key)
 	if err != nil {
 		return nil, err
 	}
-	return VectorValueParse(out), nil
+	defer closer.Close()
+	vec := VectorValueParse(out)
+	if cache != nil {
+		cache.put(&nodeCacheEntry{key: nodeCacheKey{id: id, vector: true}, vec: vec}, gen)
+	}
+	return vec, nil
 }
 
-func (graph *Graph) getLayerFriends(l uint8, a uint64, count int) ([]uint64, error) {
+// getLayerFriends returns the outgoing edges of a node in a layer, nearest
+// first. Lists written before they were bounded are cut at the layer's limit
+func (graph *Graph) getLayerFriends(l uint8, a uint64) ([]uint64, error) {
+	if m := graph.memoryView(); m != nil {
+		if friends, ok := m.friends(l, a); ok {
+			return friends, nil
+		}
+	}
+	cache := graph.readCache()
+	var gen uint64
+	if cache != nil {
+		var e *nodeCacheEntry
+		if e, gen = cache.get(nodeCacheKey{id: a, layer: l}); e != nil {
+			return e.friends, nil
+		}
+	}
+	count := graph.maxConnections(l)
 	prefix := LayerKeyPrefixEncode(graph.graphid, l, a)
 
-	iter, err := graph.db.db.NewIter(&pebble.IterOptions{LowerBound: prefix})
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix})
 	if err != nil {
 		return nil, err
 	}
@@ -277,21 +875,54 @@ func (graph *Graph) getLayerFriends(l uint8, a uint64, count int) ([]uint64, err
 		out = append(out, dest)
 		i++
 	}
+	if cache != nil {
+		cache.put(&nodeCacheEntry{key: nodeCacheKey{id: a, layer: l}, friends: out}, gen)
+	}
 	return out, nil
 }
 
 func (graph *Graph) getEntryPoint() (uint8, uint64, []float32, error) {
-	key := VectorKeyEncode(graph.graphid, 1)
-	out, closer, err := graph.db.db.Get(key)
+	for attempt := 0; ; attempt++ {
+		ep, level, err := graph.getEntryID()
+		if err != nil || ep == 0 {
+			return 0, 0, nil, err
+		}
+		v, err := graph.getVec(ep)
+		if err == pebble.ErrNotFound && attempt < 3 {
+			//entry point was deleted and replaced between reads
+			continue
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		return level, ep, v, nil
+	}
+}
+
+func (graph *Graph) getEntryID() (uint64, uint8, error) {
+	out, closer, err := graph.reader.Get(EntryKeyEncode(graph.graphid))
 	if err != nil {
 		if err == pebble.ErrNotFound {
-			return 0, 0, nil, nil
+			return 0, 0, nil
 		}
-		return 0, 0, nil, err
+		return 0, 0, err
 	}
 	defer closer.Close()
-	v := VectorValueParse(out)
-	return graph.m, 1, v, nil
+	ep, level := EntryValueParse(out)
+	return ep, level, nil
+}
+
+// getNodeLevel returns the top layer a node is linked in
+func (graph *Graph) getNodeLevel(id uint64) (uint8, error) {
+	out, closer, err := graph.reader.Get(LevelKeyEncode(graph.graphid, id))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer closer.Close()
+	return out[0], nil
 }
 
 type LayerEdge struct {
@@ -306,7 +937,7 @@ func (graph *Graph) ListLayer(layer uint8) chan *LayerEdge {
 	go func() {
 		defer close(out)
 		prefix := LayerPrefixEncode(graph.graphid, layer)
-		iter, err := graph.db.db.NewIter(&pebble.IterOptions{LowerBound: prefix})
+		iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix})
 		if err != nil {
 			return
 		}
@@ -325,7 +956,13 @@ func (graph *Graph) ListLayer(layer uint8) chan *LayerEdge {
 }
 
 func (graph *Graph) genInsertLink(graphId uint32, layer uint8, src uint64, dst uint64, dist float32) ([]byte, []byte) {
-	key := LayerKeyEncode(graphId, layer, src, dist)
+	key := LayerKeyEncode(graphId, layer, src, dist, dst)
 	value := LayerValueEncode(dst)
 	return key, value
 }
+
+func (graph *Graph) genInsertRevLink(graphId uint32, layer uint8, src uint64, dst uint64, dist float32) ([]byte, []byte) {
+	key := LayerRevKeyEncode(graphId, layer, dst, src)
+	value := LayerRevValueEncode(dist)
+	return key, value
+}
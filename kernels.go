@@ -0,0 +1,130 @@
+package hnswindex
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// distanceKernel is a set of implementations of the distance loops. The
+// pure Go one is always available; assembly versions are added at init,
+// for the instruction sets the CPU supports
+type distanceKernel struct {
+	name      string
+	squaredL2 func(a, b []float32) float32
+	dot       func(a, b []float32) float32
+	cosine    func(a, b []float32) (dot, na, nb float32)
+}
+
+var genericKernel = &distanceKernel{
+	name:      "generic",
+	squaredL2: squaredL2Generic,
+	dot:       dotGeneric,
+	cosine:    cosineGeneric,
+}
+
+// kernels lists the usable implementations, fastest first
+var kernels = []*distanceKernel{genericKernel}
+
+var activeKernel atomic.Pointer[distanceKernel]
+
+func init() {
+	kernels = append(archKernels(), kernels...)
+	activeKernel.Store(kernels[0])
+}
+
+// DistanceKernel returns the name of the implementation used to calculate
+// Euclidean, dot product and cosine distances, such as "avx2" or "generic"
+func DistanceKernel() string {
+	return activeKernel.Load().name
+}
+
+// DistanceKernels lists the implementations supported by this CPU, fastest
+// first. The fastest is used by default
+func DistanceKernels() []string {
+	out := make([]string, len(kernels))
+	for i, k := range kernels {
+		out[i] = k.name
+	}
+	return out
+}
+
+// SetDistanceKernel switches to one of the implementations listed by
+// DistanceKernels, for benchmarking or to rule out an assembly kernel when
+// debugging. Results may differ in the last bits between implementations,
+// as they add up terms in a different order
+func SetDistanceKernel(name string) error {
+	for _, k := range kernels {
+		if k.name == name {
+			activeKernel.Store(k)
+			return nil
+		}
+	}
+	return fmt.Errorf("distance kernel %s is not supported on this CPU", name)
+}
+
+func squaredL2Generic(a, b []float32) float32 {
+	s := float32(0.0)
+	for i := range a {
+		x := a[i] - b[i]
+		s += (x * x)
+	}
+	return s
+}
+
+func dotGeneric(a, b []float32) float32 {
+	s := float32(0.0)
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func cosineGeneric(a, b []float32) (float32, float32, float32) {
+	dot, na, nb := float32(0.0), float32(0.0), float32(0.0)
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	return dot, na, nb
+}
+
+// blockKernel wraps assembly loops that handle a multiple of block
+// elements, finishing any remainder in Go
+func blockKernel(name string, block int,
+	squaredL2 func(a, b *float32, n int) float32,
+	dot func(a, b *float32, n int) float32,
+	cosine func(a, b *float32, n int) (float32, float32, float32)) *distanceKernel {
+
+	return &distanceKernel{
+		name: name,
+		squaredL2: func(a, b []float32) float32 {
+			b = b[:len(a)]
+			n := len(a) - len(a)%block
+			s := float32(0.0)
+			if n > 0 {
+				s = squaredL2(&a[0], &b[0], n)
+			}
+			return s + squaredL2Generic(a[n:], b[n:])
+		},
+		dot: func(a, b []float32) float32 {
+			b = b[:len(a)]
+			n := len(a) - len(a)%block
+			s := float32(0.0)
+			if n > 0 {
+				s = dot(&a[0], &b[0], n)
+			}
+			return s + dotGeneric(a[n:], b[n:])
+		},
+		cosine: func(a, b []float32) (float32, float32, float32) {
+			b = b[:len(a)]
+			n := len(a) - len(a)%block
+			d, na, nb := float32(0.0), float32(0.0), float32(0.0)
+			if n > 0 {
+				d, na, nb = cosine(&a[0], &b[0], n)
+			}
+			td, tna, tnb := cosineGeneric(a[n:], b[n:])
+			return d + td, na + tna, nb + tnb
+		},
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !purego
+
+package hnswindex
+
+import "golang.org/x/sys/cpu"
+
+// The assembly loops take n, a non-zero multiple of 16 for AVX2, and 32 for
+// AVX-512. The AVX-512 loops only use AVX512F instructions, as that is all
+// archKernels checks for
+
+//go:noescape
+func squaredL2AVX2(a, b *float32, n int) float32
+
+//go:noescape
+func dotAVX2(a, b *float32, n int) float32
+
+//go:noescape
+func cosineAVX2(a, b *float32, n int) (dot, na, nb float32)
+
+//go:noescape
+func squaredL2AVX512(a, b *float32, n int) float32
+
+//go:noescape
+func dotAVX512(a, b *float32, n int) float32
+
+//go:noescape
+func cosineAVX512(a, b *float32, n int) (dot, na, nb float32)
+
+func archKernels() []*distanceKernel {
+	out := []*distanceKernel{}
+	if cpu.X86.HasAVX512F {
+		out = append(out, blockKernel("avx512", 32, squaredL2AVX512, dotAVX512, cosineAVX512))
+	}
+	if cpu.X86.HasAVX2 && cpu.X86.HasFMA {
+		out = append(out, blockKernel("avx2", 16, squaredL2AVX2, dotAVX2, cosineAVX2))
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// Adds the 8 floats of Y0 into the low float of X0
+#define REDUCE_Y0 \
+	VEXTRACTF128 $1, Y0, X1; \
+	VADDPS       X1, X0, X0; \
+	VHADDPS      X0, X0, X0; \
+	VHADDPS      X0, X0, X0
+
+// Adds the 16 floats of Z0 into the low float of X0
+#define REDUCE_Z0 \
+	VEXTRACTF64X4 $1, Z0, Y1; \
+	VADDPS        Y1, Y0, Y0; \
+	REDUCE_Y0
+
+// func squaredL2AVX2(a, b *float32, n int) float32
+TEXT ·squaredL2AVX2(SB), NOSPLIT, $0-28
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+
+l2avx2:
+	VMOVUPS     (SI), Y2
+	VMOVUPS     32(SI), Y3
+	VSUBPS      (DI), Y2, Y2
+	VSUBPS      32(DI), Y3, Y3
+	VFMADD231PS Y2, Y2, Y0
+	VFMADD231PS Y3, Y3, Y1
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JNZ         l2avx2
+
+	VADDPS Y1, Y0, Y0
+	REDUCE_Y0
+	VZEROUPPER
+	MOVSS  X0, ret+24(FP)
+	RET
+
+// func dotAVX2(a, b *float32, n int) float32
+TEXT ·dotAVX2(SB), NOSPLIT, $0-28
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+
+dotavx2:
+	VMOVUPS     (SI), Y2
+	VMOVUPS     32(SI), Y3
+	VFMADD231PS (DI), Y2, Y0
+	VFMADD231PS 32(DI), Y3, Y1
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JNZ         dotavx2
+
+	VADDPS Y1, Y0, Y0
+	REDUCE_Y0
+	VZEROUPPER
+	MOVSS  X0, ret+24(FP)
+	RET
+
+// func cosineAVX2(a, b *float32, n int) (dot, na, nb float32)
+TEXT ·cosineAVX2(SB), NOSPLIT, $0-36
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VXORPS Y4, Y4, Y4 // dot
+	VXORPS Y5, Y5, Y5
+	VXORPS Y6, Y6, Y6 // na
+	VXORPS Y7, Y7, Y7
+	VXORPS Y8, Y8, Y8 // nb
+	VXORPS Y9, Y9, Y9
+
+cosavx2:
+	VMOVUPS     (SI), Y10
+	VMOVUPS     32(SI), Y11
+	VMOVUPS     (DI), Y12
+	VMOVUPS     32(DI), Y13
+	VFMADD231PS Y12, Y10, Y4
+	VFMADD231PS Y13, Y11, Y5
+	VFMADD231PS Y10, Y10, Y6
+	VFMADD231PS Y11, Y11, Y7
+	VFMADD231PS Y12, Y12, Y8
+	VFMADD231PS Y13, Y13, Y9
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JNZ         cosavx2
+
+	VADDPS Y5, Y4, Y0
+	REDUCE_Y0
+	MOVSS  X0, dot+24(FP)
+	VADDPS Y7, Y6, Y0
+	REDUCE_Y0
+	MOVSS  X0, na+28(FP)
+	VADDPS Y9, Y8, Y0
+	REDUCE_Y0
+	MOVSS  X0, nb+32(FP)
+	VZEROUPPER
+	RET
+
+// func squaredL2AVX512(a, b *float32, n int) float32
+TEXT ·squaredL2AVX512(SB), NOSPLIT, $0-28
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VPXORD Z0, Z0, Z0
+	VPXORD Z1, Z1, Z1
+
+l2avx512:
+	VMOVUPS     (SI), Z2
+	VMOVUPS     64(SI), Z3
+	VSUBPS      (DI), Z2, Z2
+	VSUBPS      64(DI), Z3, Z3
+	VFMADD231PS Z2, Z2, Z0
+	VFMADD231PS Z3, Z3, Z1
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JNZ         l2avx512
+
+	VADDPS Z1, Z0, Z0
+	REDUCE_Z0
+	VZEROUPPER
+	MOVSS  X0, ret+24(FP)
+	RET
+
+// func dotAVX512(a, b *float32, n int) float32
+TEXT ·dotAVX512(SB), NOSPLIT, $0-28
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VPXORD Z0, Z0, Z0
+	VPXORD Z1, Z1, Z1
+
+dotavx512:
+	VMOVUPS     (SI), Z2
+	VMOVUPS     64(SI), Z3
+	VFMADD231PS (DI), Z2, Z0
+	VFMADD231PS 64(DI), Z3, Z1
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JNZ         dotavx512
+
+	VADDPS Z1, Z0, Z0
+	REDUCE_Z0
+	VZEROUPPER
+	MOVSS  X0, ret+24(FP)
+	RET
+
+// func cosineAVX512(a, b *float32, n int) (dot, na, nb float32)
+TEXT ·cosineAVX512(SB), NOSPLIT, $0-36
+	MOVQ a+0(FP), SI
+	MOVQ b+8(FP), DI
+	MOVQ n+16(FP), CX
+	VPXORD Z4, Z4, Z4 // dot
+	VPXORD Z5, Z5, Z5
+	VPXORD Z6, Z6, Z6 // na
+	VPXORD Z7, Z7, Z7
+	VPXORD Z8, Z8, Z8 // nb
+	VPXORD Z9, Z9, Z9
+
+cosavx512:
+	VMOVUPS     (SI), Z10
+	VMOVUPS     64(SI), Z11
+	VMOVUPS     (DI), Z12
+	VMOVUPS     64(DI), Z13
+	VFMADD231PS Z12, Z10, Z4
+	VFMADD231PS Z13, Z11, Z5
+	VFMADD231PS Z10, Z10, Z6
+	VFMADD231PS Z11, Z11, Z7
+	VFMADD231PS Z12, Z12, Z8
+	VFMADD231PS Z13, Z13, Z9
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JNZ         cosavx512
+
+	VADDPS Z5, Z4, Z0
+	REDUCE_Z0
+	MOVSS  X0, dot+24(FP)
+	VADDPS Z7, Z6, Z0
+	REDUCE_Z0
+	MOVSS  X0, na+28(FP)
+	VADDPS Z9, Z8, Z0
+	REDUCE_Z0
+	MOVSS  X0, nb+32(FP)
+	VZEROUPPER
+	RET
@@ -0,0 +1,23 @@
+//go:build !purego
+
+package hnswindex
+
+import "golang.org/x/sys/cpu"
+
+// The assembly loops take n, a non-zero multiple of 16
+
+//go:noescape
+func squaredL2NEON(a, b *float32, n int) float32
+
+//go:noescape
+func dotNEON(a, b *float32, n int) float32
+
+//go:noescape
+func cosineNEON(a, b *float32, n int) (dot, na, nb float32)
+
+func archKernels() []*distanceKernel {
+	if cpu.ARM64.HasASIMD {
+		return []*distanceKernel{blockKernel("neon", 16, squaredL2NEON, dotNEON, cosineNEON)}
+	}
+	return nil
+}
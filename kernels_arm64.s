@@ -0,0 +1,107 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// Adds the 4 floats of V0 into F0
+#define REDUCE_V0 \
+	VFADDP V0.S4, V0.S4, V0.S4; \
+	VFADDP V0.S4, V0.S4, V0.S4
+
+// func squaredL2NEON(a, b *float32, n int) float32
+TEXT ·squaredL2NEON(SB), NOSPLIT, $0-28
+	MOVD a+0(FP), R0
+	MOVD b+8(FP), R1
+	MOVD n+16(FP), R2
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	VEOR V2.B16, V2.B16, V2.B16
+	VEOR V3.B16, V3.B16, V3.B16
+
+l2neon:
+	VLD1.P 64(R0), [V4.S4, V5.S4, V6.S4, V7.S4]
+	VLD1.P 64(R1), [V8.S4, V9.S4, V10.S4, V11.S4]
+	VFSUB  V8.S4, V4.S4, V4.S4
+	VFSUB  V9.S4, V5.S4, V5.S4
+	VFSUB  V10.S4, V6.S4, V6.S4
+	VFSUB  V11.S4, V7.S4, V7.S4
+	VFMLA  V4.S4, V4.S4, V0.S4
+	VFMLA  V5.S4, V5.S4, V1.S4
+	VFMLA  V6.S4, V6.S4, V2.S4
+	VFMLA  V7.S4, V7.S4, V3.S4
+	SUBS   $16, R2, R2
+	BNE    l2neon
+
+	VFADD V1.S4, V0.S4, V0.S4
+	VFADD V3.S4, V2.S4, V2.S4
+	VFADD V2.S4, V0.S4, V0.S4
+	REDUCE_V0
+	FMOVS F0, ret+24(FP)
+	RET
+
+// func dotNEON(a, b *float32, n int) float32
+TEXT ·dotNEON(SB), NOSPLIT, $0-28
+	MOVD a+0(FP), R0
+	MOVD b+8(FP), R1
+	MOVD n+16(FP), R2
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	VEOR V2.B16, V2.B16, V2.B16
+	VEOR V3.B16, V3.B16, V3.B16
+
+dotneon:
+	VLD1.P 64(R0), [V4.S4, V5.S4, V6.S4, V7.S4]
+	VLD1.P 64(R1), [V8.S4, V9.S4, V10.S4, V11.S4]
+	VFMLA  V8.S4, V4.S4, V0.S4
+	VFMLA  V9.S4, V5.S4, V1.S4
+	VFMLA  V10.S4, V6.S4, V2.S4
+	VFMLA  V11.S4, V7.S4, V3.S4
+	SUBS   $16, R2, R2
+	BNE    dotneon
+
+	VFADD V1.S4, V0.S4, V0.S4
+	VFADD V3.S4, V2.S4, V2.S4
+	VFADD V2.S4, V0.S4, V0.S4
+	REDUCE_V0
+	FMOVS F0, ret+24(FP)
+	RET
+
+// func cosineNEON(a, b *float32, n int) (dot, na, nb float32)
+TEXT ·cosineNEON(SB), NOSPLIT, $0-36
+	MOVD a+0(FP), R0
+	MOVD b+8(FP), R1
+	MOVD n+16(FP), R2
+	VEOR V12.B16, V12.B16, V12.B16 // dot
+	VEOR V13.B16, V13.B16, V13.B16
+	VEOR V14.B16, V14.B16, V14.B16 // na
+	VEOR V15.B16, V15.B16, V15.B16
+	VEOR V16.B16, V16.B16, V16.B16 // nb
+	VEOR V17.B16, V17.B16, V17.B16
+
+cosneon:
+	VLD1.P 64(R0), [V4.S4, V5.S4, V6.S4, V7.S4]
+	VLD1.P 64(R1), [V8.S4, V9.S4, V10.S4, V11.S4]
+	VFMLA  V8.S4, V4.S4, V12.S4
+	VFMLA  V9.S4, V5.S4, V13.S4
+	VFMLA  V10.S4, V6.S4, V12.S4
+	VFMLA  V11.S4, V7.S4, V13.S4
+	VFMLA  V4.S4, V4.S4, V14.S4
+	VFMLA  V5.S4, V5.S4, V15.S4
+	VFMLA  V6.S4, V6.S4, V14.S4
+	VFMLA  V7.S4, V7.S4, V15.S4
+	VFMLA  V8.S4, V8.S4, V16.S4
+	VFMLA  V9.S4, V9.S4, V17.S4
+	VFMLA  V10.S4, V10.S4, V16.S4
+	VFMLA  V11.S4, V11.S4, V17.S4
+	SUBS   $16, R2, R2
+	BNE    cosneon
+
+	VFADD V13.S4, V12.S4, V0.S4
+	REDUCE_V0
+	FMOVS F0, dot+24(FP)
+	VFADD V15.S4, V14.S4, V0.S4
+	REDUCE_V0
+	FMOVS F0, na+28(FP)
+	VFADD V17.S4, V16.S4, V0.S4
+	REDUCE_V0
+	FMOVS F0, nb+32(FP)
+	RET
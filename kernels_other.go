@@ -0,0 +1,7 @@
+//go:build (!amd64 && !arm64) || purego
+
+package hnswindex
+
+func archKernels() []*distanceKernel {
+	return nil
+}
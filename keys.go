@@ -2,6 +2,7 @@ package hnswindex
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"math"
 )
 
@@ -10,7 +11,8 @@ import (
 // graph
 // desc : graph name to fixed int id
 // key: byte graphPrefix, []byte name
-// value : int32 id, int32 M, int32 vectorSize
+// value : int32 id, int32 M, int32 vectorSize, int32 efConstruction, int32 Mmax0,
+// float64 mL, byte flags, []byte metric name
 
 var graphPrefix byte = 'g'
 
@@ -32,6 +34,76 @@ func GraphKeyParse(key []byte) []byte {
 	return out
 }
 
+func GraphPrefix() []byte {
+	return []byte{graphPrefix}
+}
+
+const (
+	graphExtendCandidates      byte = 1
+	graphKeepPrunedConnections byte = 2
+)
+
+// GraphValueEncode stores the dimension and construction parameters of a
+// graph. The metric is stored by name
+func GraphValueEncode(graphId uint32, dim int, config GraphConfig) []byte {
+	metric := config.Metric.Name()
+	out := make([]byte, 29+len(metric))
+	binary.LittleEndian.PutUint32(out[0:], graphId)
+	binary.LittleEndian.PutUint32(out[4:], uint32(config.M))
+	binary.LittleEndian.PutUint32(out[8:], uint32(dim))
+	binary.LittleEndian.PutUint32(out[12:], uint32(config.EfConstruction))
+	binary.LittleEndian.PutUint32(out[16:], uint32(config.Mmax0))
+	binary.LittleEndian.PutUint64(out[20:], math.Float64bits(config.ML))
+	if config.ExtendCandidates {
+		out[28] |= graphExtendCandidates
+	}
+	if config.KeepPrunedConnections {
+		out[28] |= graphKeepPrunedConnections
+	}
+	copy(out[29:], metric)
+	return out
+}
+
+// GraphValueParse returns the graph id, dimension, construction parameters
+// and metric name. The Metric of the returned config is left nil, the name
+// is resolved with MetricByName
+func GraphValueParse(value []byte) (uint32, int, GraphConfig, string) {
+	config := GraphConfig{
+		M:                     int(binary.LittleEndian.Uint32(value[4:])),
+		EfConstruction:        int(binary.LittleEndian.Uint32(value[12:])),
+		Mmax0:                 int(binary.LittleEndian.Uint32(value[16:])),
+		ML:                    math.Float64frombits(binary.LittleEndian.Uint64(value[20:])),
+		ExtendCandidates:      value[28]&graphExtendCandidates != 0,
+		KeepPrunedConnections: value[28]&graphKeepPrunedConnections != 0,
+	}
+	return binary.LittleEndian.Uint32(value[0:]),
+		int(binary.LittleEndian.Uint32(value[8:])),
+		config,
+		string(value[29:])
+}
+
+// graph counter
+// desc: the last graph id handed out. Ids are never reused, so handles to a
+// dropped graph can't write into a new one
+// key: byte graphCounterPrefix
+// value: int32 id
+
+var graphCounterPrefix byte = 'G'
+
+func GraphCounterKey() []byte {
+	return []byte{graphCounterPrefix}
+}
+
+func GraphCounterValueEncode(graphId uint32) []byte {
+	out := make([]byte, 4)
+	binary.LittleEndian.PutUint32(out, graphId)
+	return out
+}
+
+func GraphCounterValueParse(value []byte) uint32 {
+	return binary.LittleEndian.Uint32(value)
+}
+
 // name
 // desc : entry name to fixed int id
 // key: int32 graphId, []byte name
@@ -65,6 +137,10 @@ func NameValueEncode(vecId uint64) []byte {
 	return out
 }
 
+func NameValueParse(value []byte) uint64 {
+	return binary.LittleEndian.Uint64(value)
+}
+
 func NameGraphPrefix(graphId uint32) []byte {
 	out := make([]byte, 5)
 	out[0] = namePrefix
@@ -115,6 +191,17 @@ func VectorKeyEncode(graphId uint32, entry uint64) []byte {
 	return out
 }
 
+func VectorKeyParse(key []byte) (uint32, uint64) {
+	return binary.LittleEndian.Uint32(key[1:]), binary.LittleEndian.Uint64(key[5:])
+}
+
+func VectorGraphPrefix(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = vectorPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
 func VectorValueEncode(vec []float32) []byte {
 	out := make([]byte, len(vec)*4)
 	for i := 0; i < len(vec); i++ {
@@ -131,6 +218,150 @@ func VectorValueParse(val []byte) []float32 {
 	return out
 }
 
+// payload
+// desc: optional metadata stored alongside a vector
+// key: int32 graphID, int64 entryID
+// value: json encoded payload
+
+var payloadPrefix byte = 'm'
+
+func PayloadKeyEncode(graphId uint32, entry uint64) []byte {
+	out := make([]byte, 13)
+	out[0] = payloadPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	binary.LittleEndian.PutUint64(out[5:], entry)
+	return out
+}
+
+func PayloadGraphPrefix(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = payloadPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+func PayloadValueEncode(p Payload) ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func PayloadValueParse(value []byte) (Payload, error) {
+	out := Payload{}
+	err := json.Unmarshal(value, &out)
+	return out, err
+}
+
+// index
+// desc: secondary index of scalar payload values, used to resolve filters
+// key: int32 graphID, uint16 field length, []byte field, byte value type, []byte value, int64 entryID
+// value: empty
+
+var indexPrefix byte = 'i'
+
+const (
+	indexString byte = 's'
+	indexNumber byte = 'n'
+	indexBool   byte = 'b'
+)
+
+func IndexGraphPrefix(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = indexPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+func IndexFieldPrefix(graphId uint32, field string) []byte {
+	out := make([]byte, 7+len(field))
+	out[0] = indexPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	binary.BigEndian.PutUint16(out[5:], uint16(len(field)))
+	copy(out[7:], field)
+	return out
+}
+
+// IndexValuePrefix encodes the key prefix shared by all entries with a field
+// value. Strings, bools and numbers can be indexed, numbers are encoded so
+// they sort in numeric order. Returns false for other types
+func IndexValuePrefix(graphId uint32, field string, value any) ([]byte, bool) {
+	out := IndexFieldPrefix(graphId, field)
+	switch v := value.(type) {
+	case string:
+		out = append(out, indexString)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(v)))
+		out = append(out, v...)
+	case bool:
+		out = append(out, indexBool)
+		if v {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+	default:
+		f, ok := toFloat64(value)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, indexNumber)
+		out = binary.BigEndian.AppendUint64(out, sortableFloat64(f))
+	}
+	return out, true
+}
+
+func IndexKeyEncode(graphId uint32, field string, value any, entry uint64) ([]byte, bool) {
+	out, ok := IndexValuePrefix(graphId, field, value)
+	if !ok {
+		return nil, false
+	}
+	return binary.BigEndian.AppendUint64(out, entry), true
+}
+
+// IndexKeyParseEntry returns the entry id at the end of an index key
+func IndexKeyParseEntry(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+func toFloat64(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func sortableFloat64(f float64) uint64 {
+	if f == 0 {
+		//so -0 and 0 have the same key
+		f = 0
+	}
+	b := math.Float64bits(f)
+	if b&0x8000000000000000 != 0 {
+		return ^b
+	}
+	return b | 0x8000000000000000
+}
+
 // layer
 // desc: layer values, connecting top M edges for each vertex for layer L
 // key: int32 graphID, int64 source, float32 distance
@@ -138,15 +369,17 @@ func VectorValueParse(val []byte) []float32 {
 
 var layerPrefix byte = 'l'
 
-func LayerKeyEncode(graphId uint32, layer uint8, source uint64, dist float32) []byte {
-	// prefix (1 byte) + graphId (4 bytes) + layer (1 byte) + source (8 bytes) + dist (4 bytes)
-	out := make([]byte, 18)
+func LayerKeyEncode(graphId uint32, layer uint8, source uint64, dist float32, dest uint64) []byte {
+	// prefix (1 byte) + graphId (4 bytes) + layer (1 byte) + source (8 bytes) + dist (4 bytes) + dest (8 bytes)
+	out := make([]byte, 26)
 	out[0] = layerPrefix
 	binary.LittleEndian.PutUint32(out[1:], graphId)
 	out[5] = layer
 	binary.LittleEndian.PutUint64(out[6:], source)
 	// bigEndian encode a 32bit float so it is sorted correctly
-	binary.BigEndian.PutUint32(out[14:], math.Float32bits(dist))
+	binary.BigEndian.PutUint32(out[14:], sortableFloat32(dist))
+	// dest keeps the key unique when two neighbors are at the same distance
+	binary.LittleEndian.PutUint64(out[18:], dest)
 	return out
 }
 
@@ -154,14 +387,32 @@ func LayerKeyParse(key []byte) (uint32, uint8, uint64, float32) {
 	return binary.LittleEndian.Uint32(key[1:]),
 		uint8(key[5]),
 		binary.LittleEndian.Uint64(key[6:]),
-		math.Float32frombits(binary.BigEndian.Uint32((key[14:])))
+		parseSortableFloat32(binary.BigEndian.Uint32((key[14:18])))
+}
+
+// sortableFloat32 maps a float to bits that sort in the same order, including
+// negative values, which some metrics produce. The sign bit is flipped for
+// positive numbers, and all bits are flipped for negative ones
+func sortableFloat32(f float32) uint32 {
+	b := math.Float32bits(f)
+	if b&0x80000000 != 0 {
+		return ^b
+	}
+	return b | 0x80000000
+}
+
+func parseSortableFloat32(b uint32) float32 {
+	if b&0x80000000 != 0 {
+		return math.Float32frombits(b &^ 0x80000000)
+	}
+	return math.Float32frombits(^b)
 }
 
 func LayerKeyPrefixEncode(graphId uint32, layer uint8, source uint64) []byte {
 	out := make([]byte, 14)
 	out[0] = layerPrefix
 	binary.LittleEndian.PutUint32(out[1:], graphId)
-	out[2] = layer
+	out[5] = layer
 	binary.LittleEndian.PutUint64(out[6:], source)
 	return out
 }
@@ -190,3 +441,175 @@ func LayerValueEncode(dest uint64) []byte {
 func LayerValueParse(value []byte) uint64 {
 	return binary.LittleEndian.Uint64(value)
 }
+
+// layerRev
+// desc: reverse index of layer edges, used to find the sources linking to a vertex
+// key: int32 graphID, uint8 layer, int64 destination, int64 source
+// value: float32 distance
+
+var layerRevPrefix byte = 'r'
+
+func LayerRevKeyEncode(graphId uint32, layer uint8, dest uint64, source uint64) []byte {
+	// prefix (1 byte) + graphId (4 bytes) + layer (1 byte) + dest (8 bytes) + source (8 bytes)
+	out := make([]byte, 22)
+	out[0] = layerRevPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	out[5] = layer
+	binary.LittleEndian.PutUint64(out[6:], dest)
+	binary.LittleEndian.PutUint64(out[14:], source)
+	return out
+}
+
+func LayerRevKeyParse(key []byte) (uint32, uint8, uint64, uint64) {
+	return binary.LittleEndian.Uint32(key[1:]),
+		uint8(key[5]),
+		binary.LittleEndian.Uint64(key[6:]),
+		binary.LittleEndian.Uint64(key[14:])
+}
+
+func LayerRevKeyPrefixEncode(graphId uint32, layer uint8, dest uint64) []byte {
+	out := make([]byte, 14)
+	out[0] = layerRevPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	out[5] = layer
+	binary.LittleEndian.PutUint64(out[6:], dest)
+	return out
+}
+
+func LayerRevPrefixEncode(graphId uint32, layer uint8) []byte {
+	out := make([]byte, 6)
+	out[0] = layerRevPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	out[5] = layer
+	return out
+}
+
+func LayerRevGraphPrefixEncode(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = layerRevPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+func LayerRevValueEncode(dist float32) []byte {
+	out := make([]byte, 4)
+	binary.BigEndian.PutUint32(out, math.Float32bits(dist))
+	return out
+}
+
+func LayerRevValueParse(value []byte) float32 {
+	return math.Float32frombits(binary.BigEndian.Uint32(value))
+}
+
+// entry
+// desc: entry point of the graph, where searches start, and its level
+// which is the top layer of the graph
+// key: int32 graphID
+// value: int64 entryID, uint8 level
+
+var entryPrefix byte = 'p'
+
+func EntryKeyEncode(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = entryPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+func EntryValueEncode(entry uint64, level uint8) []byte {
+	out := make([]byte, 9)
+	binary.LittleEndian.PutUint64(out, entry)
+	out[8] = level
+	return out
+}
+
+func EntryValueParse(value []byte) (uint64, uint8) {
+	return binary.LittleEndian.Uint64(value), value[8]
+}
+
+// counter
+// desc: upper bound of the entry ids handed out so far. Ids are reserved
+// in ranges, so the next id may be lower than this
+// key: int32 graphID
+// value: int64 id
+
+var counterPrefix byte = 'c'
+
+func CounterKeyEncode(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = counterPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+func CounterValueEncode(id uint64) []byte {
+	out := make([]byte, 8)
+	binary.LittleEndian.PutUint64(out, id)
+	return out
+}
+
+func CounterValueParse(value []byte) uint64 {
+	return binary.LittleEndian.Uint64(value)
+}
+
+// level
+// desc: top layer an entry is linked in
+// key: int32 graphID, int64 entryID
+// value: uint8 level
+
+var levelPrefix byte = 'n'
+
+func LevelKeyEncode(graphId uint32, entry uint64) []byte {
+	out := make([]byte, 13)
+	out[0] = levelPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	binary.LittleEndian.PutUint64(out[5:], entry)
+	return out
+}
+
+func LevelGraphPrefix(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = levelPrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+// tombstone
+// desc: marks an entry as deleted, it is still used to traverse the graph
+// key: int32 graphID, int64 entryID
+// value: empty
+
+var tombstonePrefix byte = 't'
+
+func TombstoneKeyEncode(graphId uint32, entry uint64) []byte {
+	out := make([]byte, 13)
+	out[0] = tombstonePrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	binary.LittleEndian.PutUint64(out[5:], entry)
+	return out
+}
+
+func TombstoneKeyParse(key []byte) (uint32, uint64) {
+	return binary.LittleEndian.Uint32(key[1:]), binary.LittleEndian.Uint64(key[5:])
+}
+
+func TombstoneGraphPrefix(graphId uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = tombstonePrefix
+	binary.LittleEndian.PutUint32(out[1:], graphId)
+	return out
+}
+
+// PrefixEnd returns the smallest key that is greater than every key
+// starting with prefix, for use as the exclusive end of a range
+func PrefixEnd(prefix []byte) []byte {
+	out := make([]byte, len(prefix))
+	copy(out, prefix)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			return out[:i+1]
+		}
+	}
+	return nil
+}
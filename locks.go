@@ -0,0 +1,149 @@
+package hnswindex
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// number of stripes used to lock node neighbor lists
+const nodeLockStripes = 1024
+
+// graphLocks coordinates writers to one graph. It is shared by every Graph
+// opened on the same DB with the same id
+type graphLocks struct {
+	write   sync.RWMutex             //held for reading by single writes, and for writing by bulk inserts
+	dropped bool                     //set by DropGraph while holding write
+	names   sync.Mutex               //held while checking a name and allocating its id
+	pending map[string]chan struct{} //names being written, closed once committed
+	entry   sync.Mutex               //held while reading and replacing the entry point
+	ids     idAllocator
+	nodes   [nodeLockStripes]sync.Mutex
+}
+
+func (db *DB) getGraphLocks(graphId uint32) *graphLocks {
+	l, _ := db.graphLocks.LoadOrStore(graphId, &graphLocks{pending: map[string]chan struct{}{}})
+	return l.(*graphLocks)
+}
+
+// checkLive returns ErrGraphNotFound if the graph was dropped after it was
+// opened. Writers call it while holding locks.write, so nothing is written
+// under the id of a dropped graph
+func (graph *Graph) checkLive() error {
+	if graph.locks.dropped {
+		return fmt.Errorf("%w: %s was dropped", ErrGraphNotFound, graph.name)
+	}
+	return nil
+}
+
+// lockNodes locks the neighbor lists of ids. Lists are locked in stripe
+// order, so concurrent writers can't deadlock. Any node whose edges are
+// changed must be locked until the batch changing them is committed.
+// Returns the function to unlock them
+func (l *graphLocks) lockNodes(ids []uint64) func() {
+	stripes := make([]int, len(ids))
+	for i, id := range ids {
+		stripes[i] = int(id % nodeLockStripes)
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, s := range stripes {
+		l.nodes[s].Lock()
+	}
+	return func() {
+		for _, s := range stripes {
+			l.nodes[s].Unlock()
+		}
+	}
+}
+
+// holdName marks name as being written. Returns the function to release
+// it, which wakes writers waiting for the name. l.names must be held
+func (l *graphLocks) holdName(name string) func() {
+	done := make(chan struct{})
+	l.pending[name] = done
+	return func() {
+		l.names.Lock()
+		delete(l.pending, name)
+		l.names.Unlock()
+		close(done)
+	}
+}
+
+// covers reports whether the stripes of locked include those of every id
+func (l *graphLocks) covers(locked []uint64, ids []uint64) bool {
+	held := make(map[uint64]bool, len(locked))
+	for _, id := range locked {
+		held[id%nodeLockStripes] = true
+	}
+	for _, id := range ids {
+		if !held[id%nodeLockStripes] {
+			return false
+		}
+	}
+	return true
+}
+
+// lockNeighborhood locks a node along with every node it links to or that
+// links to it, in any layer, so the node can be unlinked and its
+// in-neighbors repaired with edges to its out-neighbors. The nodes in extra
+// are locked too. Returns the function to unlock them, and the ids that
+// were locked
+func (graph *Graph) lockNeighborhood(id uint64, extra ...uint64) (func(), []uint64, error) {
+	for {
+		near, err := graph.getNeighbors(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		locked := append(append(near, id), extra...)
+		unlock := graph.locks.lockNodes(locked)
+		//edges may have been added before the locks were taken
+		now, err := graph.getNeighbors(id)
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		if isSubset(now, near) {
+			return unlock, locked, nil
+		}
+		unlock()
+	}
+}
+
+// getNeighbors lists the nodes with an edge to or from id in any of its
+// layers
+func (graph *Graph) getNeighbors(id uint64) ([]uint64, error) {
+	level, err := graph.getNodeLevel(id)
+	if err != nil {
+		return nil, err
+	}
+	out := []uint64{}
+	for l := 0; l <= int(level); l++ {
+		in, err := graph.getLayerRevLinks(uint8(l), id)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range in {
+			out = append(out, e.Source)
+		}
+		links, err := graph.getLayerLinks(uint8(l), id)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range links {
+			out = append(out, e.Dest)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// isSubset reports whether every element of a is in b. Both must be sorted
+func isSubset(a, b []uint64) bool {
+	for _, x := range a {
+		if _, found := slices.BinarySearch(b, x); !found {
+			return false
+		}
+	}
+	return true
+}
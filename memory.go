@@ -0,0 +1,470 @@
+package hnswindex
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// approximate size of each batch used to copy a graph into memory
+const memoryLoadBatchSize = 4 << 20
+
+// MemoryOptions controls a graph loaded with LoadGraphInMemoryWithOptions
+type MemoryOptions struct {
+	// SnapshotInterval, if set, persists changes back to the DB this often
+	SnapshotInterval time.Duration
+	// SnapshotError, if set, is called when a periodic snapshot fails
+	SnapshotError func(error)
+}
+
+// memGraph holds a graph loaded into memory. Every key of the graph is
+// copied into an in-memory pebble instance, so writes take the same paths
+// as they do on disk. Searches read vectors from a flat arena, and
+// neighbor lists from per-node arrays, which are refreshed from the
+// in-memory store after each batch is committed. The keys changed by each
+// batch are remembered, and written back to the DB by snapshot.
+//
+// The arena and arrays duplicate what is in the in-memory store, trading
+// RAM for lookups that don't go through pebble, see LoadGraphInMemory
+type memGraph struct {
+	disk  *DB
+	mem   *pebble.DB
+	dim   int
+	maxM  int
+	maxM0 int
+
+	mutex   sync.RWMutex
+	slots   map[uint64]int //node id to its slot in vectors and adj
+	vectors []float32      //dim floats per slot. Only ever appended to
+	adj     [][][]uint64   //friends of each slot in each layer, nearest first
+	dead    int            //slots no longer used by a node
+	dirty   map[string]bool
+
+	snapshotMutex sync.Mutex
+	closed        bool //set by Close once mem is closed, under snapshotMutex
+	stop          chan struct{}
+	closeOnce     sync.Once
+	stopped       sync.WaitGroup
+}
+
+// LoadGraphInMemory opens a graph with its vectors and edges held in RAM.
+// The returned Graph has the same API as one opened with OpenGraph, but
+// searches don't touch storage. Changes are kept in memory until Snapshot
+// or Close writes them back to the DB. While it is loaded, the graph must
+// not be changed through other handles.
+//
+// Every vector is held twice: once in an in-memory copy of all the graph's
+// keys, which also holds its names, payloads and edges in both directions,
+// and once in the flat arena searches read from. Neighbor lists add 8 bytes
+// per edge on top of that. Plan for about the graph's size on disk,
+// uncompressed, plus 4*dim bytes per vector. Replacing vectors with Upsert
+// leaves unused arena slots, which are reclaimed once they outnumber the
+// live ones, so the arena can briefly grow to twice that size
+func (db *DB) LoadGraphInMemory(name string) (*Graph, error) {
+	return db.LoadGraphInMemoryWithOptions(name, MemoryOptions{})
+}
+
+// LoadGraphInMemoryWithOptions works like LoadGraphInMemory, with control
+// over periodic snapshots
+func (db *DB) LoadGraphInMemoryWithOptions(name string, opts MemoryOptions) (*Graph, error) {
+	disk, err := db.OpenGraph(name)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		return nil, err
+	}
+	m := &memGraph{
+		disk:  db,
+		mem:   mem,
+		dim:   disk.dim,
+		maxM:  disk.maxM,
+		maxM0: disk.maxM0,
+		slots: map[uint64]int{},
+		dirty: map[string]bool{},
+		stop:  make(chan struct{}),
+	}
+	if err := m.load(disk.graphid); err != nil {
+		mem.Close()
+		return nil, err
+	}
+
+	memDB := &DB{db: mem}
+	memDB.noSync.Store(true)
+	graph := newGraph(memDB, disk.graphid, name, disk.dim, disk.Config())
+	graph.memory = m
+	//share the locks of the DB, so DropGraph and other handles see writers
+	graph.locks = disk.locks
+
+	if opts.SnapshotInterval > 0 {
+		m.stopped.Add(1)
+		go func() {
+			defer m.stopped.Done()
+			ticker := time.NewTicker(opts.SnapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := graph.Snapshot(); err != nil && opts.SnapshotError != nil {
+						opts.SnapshotError(err)
+					}
+				case <-m.stop:
+					return
+				}
+			}
+		}()
+	}
+	return graph, nil
+}
+
+// load copies the keys of a graph from the DB, and builds the vector arena
+// and neighbor arrays
+func (m *memGraph) load(graphId uint32) error {
+	snap := m.disk.db.NewSnapshot()
+	defer snap.Close()
+	batch := m.mem.NewBatch()
+	for _, prefix := range graphPrefixes(graphId) {
+		iter, err := snap.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+		if err != nil {
+			batch.Close()
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			key, value := iter.Key(), iter.Value()
+			if err := batch.Set(key, value, nil); err != nil {
+				iter.Close()
+				batch.Close()
+				return err
+			}
+			switch {
+			case len(key) == 13 && key[0] == vectorPrefix:
+				_, id := VectorKeyParse(key)
+				m.setVector(m.slot(id), VectorValueParse(value))
+			case len(key) == 26 && key[0] == layerPrefix:
+				_, layer, src, _ := LayerKeyParse(key)
+				s := m.slot(src)
+				friends := m.layerOf(s, layer)
+				if len(*friends) < m.maxConnections(layer) {
+					*friends = append(*friends, LayerValueParse(value))
+				}
+			}
+			if batch.Len() >= memoryLoadBatchSize {
+				if err := batch.Commit(pebble.NoSync); err != nil {
+					iter.Close()
+					batch.Close()
+					return err
+				}
+				batch.Close()
+				batch = m.mem.NewBatch()
+			}
+		}
+		if err := iter.Close(); err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	defer batch.Close()
+	return batch.Commit(pebble.NoSync)
+}
+
+func (m *memGraph) maxConnections(layer uint8) int {
+	if layer == 0 {
+		return m.maxM0
+	}
+	return m.maxM
+}
+
+// slot returns the slot of a node, adding one if needed. The mutex must be
+// held for writing
+func (m *memGraph) slot(id uint64) int {
+	if s, ok := m.slots[id]; ok {
+		return s
+	}
+	s := len(m.adj)
+	m.slots[id] = s
+	m.adj = append(m.adj, nil)
+	m.vectors = append(m.vectors, make([]float32, m.dim)...)
+	return s
+}
+
+// setVector stores the vector of a slot. A slot's vector is never changed
+// once set, as searches may still be reading it, so a node whose vector is
+// replaced moves to a new slot
+func (m *memGraph) setVector(s int, vec []float32) {
+	copy(m.vectors[s*m.dim:(s+1)*m.dim], vec)
+}
+
+func (m *memGraph) layerOf(s int, layer uint8) *[]uint64 {
+	for len(m.adj[s]) <= int(layer) {
+		m.adj[s] = append(m.adj[s], nil)
+	}
+	return &m.adj[s][layer]
+}
+
+// vector returns the vector of a node, shared with the arena. Like
+// friends, it returns false if the node is not in memory
+func (m *memGraph) vector(id uint64) ([]float32, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.vectorLocked(id)
+}
+
+func (m *memGraph) vectorLocked(id uint64) ([]float32, bool) {
+	s, ok := m.slots[id]
+	if !ok {
+		return nil, false
+	}
+	return m.vectors[s*m.dim : (s+1)*m.dim : (s+1)*m.dim], true
+}
+
+func (m *memGraph) vectorsOf(ids []uint64) [][]float32 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	out := make([][]float32, len(ids))
+	for i, id := range ids {
+		out[i], _ = m.vectorLocked(id)
+	}
+	return out
+}
+
+// friends returns the neighbors of a node in a layer. Returns false if the
+// node is not in memory, which happens briefly after a batch adding it is
+// committed, so it must be read from the store instead
+func (m *memGraph) friends(layer uint8, id uint64) ([]uint64, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	s, ok := m.slots[id]
+	if !ok {
+		return nil, false
+	}
+	if len(m.adj[s]) <= int(layer) {
+		return []uint64{}, true
+	}
+	return m.adj[s][layer], true
+}
+
+// apply records the keys written by a committed batch, and refreshes the
+// vectors and neighbor lists it changed from the in-memory store. Values
+// are read back rather than taken from the batch, so batches applied out
+// of order still leave the latest state
+func (m *memGraph) apply(graphId uint32, batch *pebble.Batch) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vecs := map[uint64]bool{}
+	layers := map[nodeCacheKey]bool{}
+	r := batch.Reader()
+	for {
+		_, key, _, ok, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		m.dirty[string(key)] = true
+		switch {
+		case len(key) == 13 && key[0] == vectorPrefix:
+			if g, id := VectorKeyParse(key); g == graphId {
+				vecs[id] = true
+			}
+		case len(key) == 26 && key[0] == layerPrefix:
+			if g, layer, src, _ := LayerKeyParse(key); g == graphId {
+				layers[nodeCacheKey{id: src, layer: layer}] = true
+			}
+		}
+	}
+	for id := range vecs {
+		if err := m.reloadVector(graphId, id); err != nil {
+			return err
+		}
+	}
+	for k := range layers {
+		if err := m.reloadFriends(graphId, k.layer, k.id); err != nil {
+			return err
+		}
+	}
+	if m.dead > 1024 && m.dead > len(m.slots) {
+		m.compact()
+	}
+	return nil
+}
+
+func (m *memGraph) reloadVector(graphId uint32, id uint64) error {
+	val, closer, err := m.mem.Get(VectorKeyEncode(graphId, id))
+	if err == pebble.ErrNotFound {
+		if s, ok := m.slots[id]; ok {
+			delete(m.slots, id)
+			m.adj[s] = nil
+			m.dead++
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	vec := VectorValueParse(val)
+	closer.Close()
+	old, ok := m.slots[id]
+	if ok {
+		if slices.Equal(m.vectors[old*m.dim:(old+1)*m.dim], vec) {
+			return nil
+		}
+		//move to a new slot, keeping the neighbor lists
+		delete(m.slots, id)
+		m.dead++
+	}
+	s := m.slot(id)
+	m.setVector(s, vec)
+	if ok {
+		m.adj[s], m.adj[old] = m.adj[old], nil
+	}
+	return nil
+}
+
+func (m *memGraph) reloadFriends(graphId uint32, layer uint8, id uint64) error {
+	prefix := LayerKeyPrefixEncode(graphId, layer, id)
+	iter, err := m.mem.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	friends := []uint64{}
+	for iter.First(); iter.Valid() && len(friends) < m.maxConnections(layer); iter.Next() {
+		friends = append(friends, LayerValueParse(iter.Value()))
+	}
+	s, ok := m.slots[id]
+	if !ok {
+		if len(friends) == 0 {
+			return nil
+		}
+		s = m.slot(id)
+	}
+	*m.layerOf(s, layer) = friends
+	return nil
+}
+
+// compact copies the vectors in use to a new arena, dropping unused slots.
+// Searches still reading the old arena keep their copy
+func (m *memGraph) compact() {
+	slots := make(map[uint64]int, len(m.slots))
+	vectors := make([]float32, 0, len(m.slots)*m.dim)
+	adj := make([][][]uint64, 0, len(m.slots))
+	for id, s := range m.slots {
+		slots[id] = len(adj)
+		vectors = append(vectors, m.vectors[s*m.dim:(s+1)*m.dim]...)
+		adj = append(adj, m.adj[s])
+	}
+	m.slots, m.vectors, m.adj, m.dead = slots, vectors, adj, 0
+}
+
+// memoryView returns the in-memory graph, or nil if the graph is stored on
+// disk, or reads through a batch
+func (graph *Graph) memoryView() *memGraph {
+	if graph.memory == nil || graph.reader != pebble.Reader(graph.db.db) {
+		return nil
+	}
+	return graph.memory
+}
+
+// Snapshot writes the changes made to a graph loaded with LoadGraphInMemory
+// back to the DB, in a single batch. Writers wait while it runs; searches
+// don't. For graphs stored on disk, or closed, it does nothing
+func (graph *Graph) Snapshot() error {
+	m := graph.memory
+	if m == nil {
+		return nil
+	}
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	return graph.snapshot()
+}
+
+// snapshot writes back the changed keys. m.snapshotMutex must be held
+func (graph *Graph) snapshot() error {
+	m := graph.memory
+	if m.closed {
+		//everything was written back by Close
+		return nil
+	}
+	graph.locks.write.Lock()
+	defer graph.locks.write.Unlock()
+	if graph.locks.dropped {
+		//nothing left to write back
+		return nil
+	}
+
+	m.mutex.Lock()
+	dirty := m.dirty
+	m.dirty = map[string]bool{}
+	m.mutex.Unlock()
+	//ids are reserved without a batch, so the counter is always copied
+	dirty[string(CounterKeyEncode(graph.graphid))] = true
+
+	batch := m.disk.db.NewBatch()
+	defer batch.Close()
+	for key := range dirty {
+		val, closer, err := m.mem.Get([]byte(key))
+		if err == pebble.ErrNotFound {
+			err = batch.Delete([]byte(key), nil)
+		} else if err == nil {
+			err = batch.Set([]byte(key), val, nil)
+			closer.Close()
+		}
+		if err != nil {
+			m.restoreDirty(dirty)
+			return err
+		}
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		m.restoreDirty(dirty)
+		return err
+	}
+	m.disk.getGraphCache(graph.graphid).invalidateBatch(graph.graphid, batch)
+	return nil
+}
+
+// restoreDirty puts back keys that failed to be written by a snapshot
+func (m *memGraph) restoreDirty(dirty map[string]bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k := range dirty {
+		m.dirty[k] = true
+	}
+}
+
+// Close releases a graph loaded with LoadGraphInMemory, after writing its
+// changes back to the DB with Snapshot. It must be called before the DB is
+// closed. For graphs stored on disk, or already closed, it does nothing
+func (graph *Graph) Close() error {
+	m := graph.memory
+	if m == nil {
+		return nil
+	}
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.stopped.Wait()
+	})
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	if err := graph.snapshot(); err != nil {
+		return err
+	}
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.mem.Close()
+}
+
+// checkOnDisk returns an error for operations that need the graph to be
+// stored on disk
+func (graph *Graph) checkOnDisk(op string) error {
+	if graph.memory != nil {
+		return fmt.Errorf("graph %s: %s is not supported on a graph loaded in memory", graph.name, op)
+	}
+	return nil
+}
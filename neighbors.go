@@ -0,0 +1,165 @@
+package hnswindex
+
+import (
+	"github.com/bmeg/hnsw-index/distqueue"
+	"github.com/cockroachdb/pebble"
+)
+
+// maxConnections is the largest number of outgoing edges a node keeps in a
+// layer. Layer 0 holds every node, so it is allowed more
+func (graph *Graph) maxConnections(layer uint8) int {
+	if layer == 0 {
+		return graph.maxM0
+	}
+	return graph.maxM
+}
+
+// selectNeighbors picks up to M neighbors for the node src, stored at vec,
+// from cands, using the heuristic from the HNSW paper. Candidates are visited
+// nearest first, and one is only kept if it is closer to vec than to every
+// neighbor already kept, so the edges spread out in different directions
+// rather than all pointing into the nearest cluster. Nodes in exclude are
+// never selected
+func (graph *Graph) selectNeighbors(src uint64, vec []float32, cands []distqueue.Element[float32, uint64], M int, layer uint8, exclude map[uint64]bool) ([]distqueue.Element[float32, uint64], error) {
+	seen := map[uint64]bool{src: true}
+	w := distqueue.NewMin[float32, uint64]()
+	for _, c := range cands {
+		if !seen[c.Value] && !exclude[c.Value] {
+			seen[c.Value] = true
+			w.Insert(c.Dist, c.Value)
+		}
+	}
+	if graph.extendCandidates {
+		adj := []uint64{}
+		for _, c := range cands {
+			friends, err := graph.getLayerFriends(layer, c.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range friends {
+				if !seen[f] && !exclude[f] {
+					seen[f] = true
+					adj = append(adj, f)
+				}
+			}
+		}
+		adj, adjDists, err := graph.getDistances(vec, adj)
+		if err != nil {
+			return nil, err
+		}
+		for i := range adj {
+			w.Insert(adjDists[i], adj[i])
+		}
+	}
+	if len(w) <= M && !graph.extendCandidates {
+		return w.Ascending(), nil
+	}
+
+	ids := make([]uint64, len(w))
+	for i := range w {
+		ids[i] = w[i].Value
+	}
+	vecs, err := graph.getVectors(ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]distqueue.Element[float32, uint64], 0, M)
+	pruned := []distqueue.Element[float32, uint64]{}
+	for len(w) > 0 && len(out) < M {
+		d, e := w.Pop()
+		eVec, ok := vecs[e]
+		if !ok {
+			//removed by a concurrent delete
+			continue
+		}
+		keep := true
+		for _, r := range out {
+			if graph.metric.Distance(eVec, vecs[r.Value]) < d {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, distqueue.Element[float32, uint64]{Dist: d, Value: e})
+		} else {
+			pruned = append(pruned, distqueue.Element[float32, uint64]{Dist: d, Value: e})
+		}
+	}
+	if graph.keepPrunedConnections {
+		for i := 0; i < len(pruned) && len(out) < M; i++ {
+			out = append(out, pruned[i])
+		}
+	}
+	return out, nil
+}
+
+// addLink adds an edge from src to dst. If the neighbor list of src is
+// already full, it is shrunk back down with selectNeighbors, which may
+// drop the new edge
+func (graph *Graph) addLink(batch *pebble.Batch, layer uint8, src uint64, dst uint64, dist float32) error {
+	existing, err := graph.getLayerLinks(layer, src)
+	if err != nil {
+		return err
+	}
+	if len(existing) < graph.maxConnections(layer) {
+		graph.setLink(batch, layer, src, dst, dist)
+		return nil
+	}
+	srcVec, err := graph.getVec(src)
+	if err == pebble.ErrNotFound {
+		//removed by a concurrent delete
+		return nil
+	} else if err != nil {
+		return err
+	}
+	added := []distqueue.Element[float32, uint64]{{Dist: dist, Value: dst}}
+	return graph.pruneLinks(batch, layer, src, srcVec, existing, added, nil)
+}
+
+// pruneLinks replaces the outgoing edges of src with the ones selectNeighbors
+// picks from its existing edges and added. Edges that are not selected are
+// deleted
+func (graph *Graph) pruneLinks(batch *pebble.Batch, layer uint8, src uint64, srcVec []float32, existing []*LayerEdge, added []distqueue.Element[float32, uint64], exclude map[uint64]bool) error {
+	cands := make([]distqueue.Element[float32, uint64], 0, len(existing)+len(added))
+	for _, e := range existing {
+		cands = append(cands, distqueue.Element[float32, uint64]{Dist: e.Dist, Value: e.Dest})
+	}
+	cands = append(cands, added...)
+	keep, err := graph.selectNeighbors(src, srcVec, cands, graph.maxConnections(layer), layer, exclude)
+	if err != nil {
+		return err
+	}
+	kept := make(map[uint64]bool, len(keep))
+	for _, k := range keep {
+		kept[k.Value] = true
+	}
+	linked := make(map[uint64]bool, len(existing))
+	for _, e := range existing {
+		linked[e.Dest] = true
+		if !kept[e.Dest] {
+			graph.deleteLink(batch, layer, e)
+		}
+	}
+	for _, k := range keep {
+		if !linked[k.Value] {
+			graph.setLink(batch, layer, src, k.Value, k.Dist)
+		}
+	}
+	return nil
+}
+
+// getVectors reads the stored vectors of a set of nodes. Nodes that have
+// been removed are left out
+func (graph *Graph) getVectors(ids []uint64) (map[uint64][]float32, error) {
+	vecs, err := graph.readVectors(ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[uint64][]float32, len(ids))
+	for i, id := range ids {
+		if vecs[i] != nil {
+			out[id] = vecs[i]
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package hnswindex
+
+import (
+	"github.com/cockroachdb/pebble"
+)
+
+// Payload is metadata stored alongside a vector. Values must be encodable
+// as JSON; numbers are returned as float64, and []byte values as base64
+// strings
+type Payload map[string]any
+
+// GetPayload returns the payload stored with a vector, or nil if it has none
+func (graph *Graph) GetPayload(name []byte) (Payload, error) {
+	id, err := graph.db.getVectorID(graph.graphid, name)
+	if err != nil {
+		return nil, err
+	}
+	return graph.getPayload(id)
+}
+
+// SetPayload replaces the payload of a stored vector. A nil payload
+// removes it
+func (graph *Graph) SetPayload(name []byte, payload Payload) error {
+	id, err := graph.db.getVectorID(graph.graphid, name)
+	if err != nil {
+		return err
+	}
+	return graph.writePayload(id, payload)
+}
+
+// writePayload replaces the payload of a node in its own batch
+func (graph *Graph) writePayload(id uint64, payload Payload) error {
+	//the old payload is read to remove its index keys, so the node is locked
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	if err := graph.checkLive(); err != nil {
+		return err
+	}
+	unlock := graph.locks.lockNodes([]uint64{id})
+	defer unlock()
+	batch := graph.db.db.NewBatch()
+	defer batch.Close()
+	if err := graph.setPayload(batch, id, payload); err != nil {
+		return err
+	}
+	return graph.commit(batch)
+}
+
+func (graph *Graph) getPayload(id uint64) (Payload, error) {
+	val, closer, err := graph.reader.Get(PayloadKeyEncode(graph.graphid, id))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+	return PayloadValueParse(val)
+}
+
+// setPayload writes a payload and its index keys, replacing the index
+// keys of the previously stored payload. A nil payload removes both
+func (graph *Graph) setPayload(w pebble.Writer, id uint64, payload Payload) error {
+	old, err := graph.getPayload(id)
+	if err != nil {
+		return err
+	}
+	for _, k := range graph.indexKeys(id, old) {
+		if err := w.Delete(k, nil); err != nil {
+			return err
+		}
+	}
+
+	key := PayloadKeyEncode(graph.graphid, id)
+	if payload == nil {
+		return w.Delete(key, nil)
+	}
+	val, err := PayloadValueEncode(payload)
+	if err != nil {
+		return err
+	}
+	if err := w.Set(key, val, nil); err != nil {
+		return err
+	}
+	//index the decoded payload, so values have the same types as
+	//when they are read back
+	stored, err := PayloadValueParse(val)
+	if err != nil {
+		return err
+	}
+	for _, k := range graph.indexKeys(id, stored) {
+		if err := w.Set(k, []byte{}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKeys lists the index keys of the scalar fields of a payload. Each
+// scalar element of an array field is indexed separately
+func (graph *Graph) indexKeys(id uint64, payload Payload) [][]byte {
+	out := [][]byte{}
+	for field, value := range payload {
+		values := []any{value}
+		if a, ok := value.([]any); ok {
+			values = a
+		}
+		for _, v := range values {
+			if k, ok := IndexKeyEncode(graph.graphid, field, v, id); ok {
+				out = append(out, k)
+			}
+		}
+	}
+	return out
+}
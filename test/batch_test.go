@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestInsertBatch(t *testing.T) {
+	dbname := "test_batch." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Insert([]byte("existing"), randomVec(dim)); err != nil {
+		t.Fatal(err)
+	}
+
+	names := [][]byte{}
+	vecs := [][]float32{}
+	for i := 0; i < 1000; i++ {
+		names = append(names, []byte(fmt.Sprintf("%d", i)))
+		vecs = append(vecs, randomVec(dim))
+	}
+	names = append(names, []byte("5"), []byte("existing"), []byte("short"))
+	vecs = append(vecs, randomVec(dim), randomVec(dim), randomVec(dim-1))
+
+	commits := 0
+	errs, err := g.InsertBatchWithOptions(names, vecs, hnswindex.BatchOptions{
+		CommitSize: 300,
+		Progress: func(inserted, failed int) {
+			commits++
+			fmt.Printf("batch progress: %d inserted, %d failed\n", inserted, failed)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits != 4 {
+		t.Errorf("expected 4 commits, got %d", commits)
+	}
+	for i, e := range errs {
+		switch {
+		case i < 1000 && e != nil:
+			t.Errorf("item %d failed: %s", i, e)
+		case (i == 1000 || i == 1001) && !errors.Is(e, hnswindex.ErrDuplicateName):
+			t.Errorf("item %d: expected ErrDuplicateName, got %v", i, e)
+		case i == 1002 && e == nil:
+			t.Errorf("expected error for wrong dimension")
+		}
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 1001 {
+		t.Errorf("expected 1001 vectors, found %d", graphs[0].Count)
+	}
+	found := 0
+	for i := 0; i < 1000; i++ {
+		out, err := g.Search(vecs[i], 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == string(names[i]) {
+			found++
+		}
+	}
+	fmt.Printf("self recall after batch insert: %d/1000\n", found)
+	if found < 900 {
+		t.Errorf("self recall too low: %d/1000", found)
+	}
+}
+
+func TestInsertStream(t *testing.T) {
+	dbname := "test_batch." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 8
+	g, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := make(chan hnswindex.BatchItem)
+	go func() {
+		defer close(items)
+		for i := 0; i < 250; i++ {
+			items <- hnswindex.BatchItem{
+				Name: []byte(fmt.Sprintf("%d", i)), Vector: randomVec(dim),
+				Payload: hnswindex.Payload{"even": i%2 == 0},
+			}
+		}
+	}()
+	stats, err := g.InsertStream(context.Background(), items, hnswindex.BatchOptions{CommitSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 250 || stats.Failed != 0 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+	out, err := g.SearchWhere(randomVec(dim), 10, 50, hnswindex.Eq("even", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 10 {
+		t.Errorf("expected 10 results, got %d", len(out))
+	}
+	for _, r := range out {
+		if r.Payload["even"] != true {
+			t.Errorf("result %s does not match filter", r.Name)
+		}
+	}
+
+	//a cancelled stream stops without waiting for more items
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.InsertStream(ctx, make(chan hnswindex.BatchItem), hnswindex.BatchOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestBuilder(t *testing.T) {
+	dbname := "test_builder." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := [][]byte{}
+	vecs := [][]float32{}
+	for i := 0; i < 1000; i++ {
+		names = append(names, []byte(fmt.Sprintf("%d", i)))
+		vecs = append(vecs, randomVec(dim))
+	}
+	names = append(names, []byte("5"))
+	vecs = append(vecs, randomVec(dim))
+
+	done := 0
+	b := g.NewBuilder(hnswindex.BuildOptions{Workers: 8, Progress: func(n int) { done = n }})
+	errs, err := b.Build(context.Background(), names, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != len(names) {
+		t.Errorf("progress reported %d of %d", done, len(names))
+	}
+	for i, e := range errs {
+		if i < 1000 && e != nil {
+			t.Errorf("item %d failed: %s", i, e)
+		}
+	}
+	if !errors.Is(errs[1000], hnswindex.ErrDuplicateName) {
+		t.Errorf("expected ErrDuplicateName, got %v", errs[1000])
+	}
+
+	found := 0
+	for i := 0; i < 1000; i++ {
+		out, err := g.Search(vecs[i], 1, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == string(names[i]) {
+			found++
+		}
+	}
+	fmt.Printf("self recall after parallel build: %d/%d\n", found, 1000)
+	if found < 900 {
+		t.Errorf("self recall too low: %d/%d", found, 1000)
+	}
+}
+
+func TestBuilderDeterministic(t *testing.T) {
+	dim := 8
+	names := [][]byte{}
+	vecs := [][]float32{}
+	for i := 0; i < 300; i++ {
+		names = append(names, []byte(fmt.Sprintf("%d", i)))
+		vecs = append(vecs, randomVec(dim))
+	}
+
+	build := func() []string {
+		dbname := "test_builder." + RandomString(5)
+		defer os.RemoveAll(dbname)
+		idx, err := hnswindex.New(dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+		g, err := idx.NewGraph("graph1", dim, 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := g.NewBuilder(hnswindex.BuildOptions{Workers: 1, Seed: 42})
+		if _, err := b.Build(context.Background(), names, vecs); err != nil {
+			t.Fatal(err)
+		}
+		edges := []string{}
+		for l := 0; l < 8; l++ {
+			for e := range g.ListLayer(uint8(l)) {
+				edges = append(edges, fmt.Sprintf("%d:%d->%d", l, e.Source, e.Dest))
+			}
+		}
+		return edges
+	}
+	a := build()
+	b := build()
+	if len(a) == 0 || !slices.Equal(a, b) {
+		t.Errorf("builds with the same seed differ: %d and %d edges", len(a), len(b))
+	}
+}
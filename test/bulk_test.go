@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestBulkLoad(t *testing.T) {
+	dbname := "test_bulk." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := [][]byte{}
+	vecs := [][]float32{}
+	payloads := []hnswindex.Payload{}
+	for i := 0; i < 1000; i++ {
+		names = append(names, []byte(fmt.Sprintf("%d", i)))
+		vecs = append(vecs, randomVec(dim))
+		payloads = append(payloads, hnswindex.Payload{"even": i%2 == 0})
+	}
+	names = append(names, []byte("5"))
+	vecs = append(vecs, randomVec(dim))
+	payloads = append(payloads, nil)
+
+	tmp := t.TempDir()
+	errs, err := g.BulkLoad(context.Background(), names, vecs, payloads, hnswindex.BulkOptions{BuildOptions: hnswindex.BuildOptions{Workers: 4}, TempDir: tmp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := os.ReadDir(tmp); err != nil || len(files) != 0 {
+		t.Errorf("scratch files left after bulk load: %v %v", files, err)
+	}
+	if files, err := filepath.Glob(filepath.Join(dbname, "*bulk-*")); err != nil || len(files) != 0 {
+		t.Errorf("scratch files written to the store: %v %v", files, err)
+	}
+	for i, e := range errs {
+		if i < 1000 && e != nil {
+			t.Errorf("item %d failed: %s", i, e)
+		}
+	}
+	if !errors.Is(errs[1000], hnswindex.ErrDuplicateName) {
+		t.Errorf("expected ErrDuplicateName, got %v", errs[1000])
+	}
+
+	//only an empty graph can be bulk loaded
+	if _, err := g.BulkLoad(context.Background(), names[:1], vecs[:1], nil, hnswindex.BulkOptions{}); err == nil {
+		t.Errorf("expected bulk load of a non-empty graph to fail")
+	}
+
+	//ids continue after the loaded ones
+	if err := g.Insert([]byte("after"), vecs[0]); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	g, err = idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 1001 {
+		t.Errorf("expected 1001 vectors, found %d", graphs[0].Count)
+	}
+
+	found := 0
+	for i := 0; i < 1000; i++ {
+		out, err := g.Search(vecs[i], 2, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range out {
+			if string(r.Name) == string(names[i]) {
+				found++
+			}
+		}
+	}
+	fmt.Printf("self recall after bulk load: %d/%d\n", found, 1000)
+	if found < 900 {
+		t.Errorf("self recall too low: %d/%d", found, 1000)
+	}
+
+	out, err := g.SearchWhere(randomVec(dim), 10, 50, hnswindex.Eq("even", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 10 {
+		t.Errorf("expected 10 results, got %d", len(out))
+	}
+	for _, r := range out {
+		if r.Payload["even"] != true {
+			t.Errorf("result %s does not match filter", r.Name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestNodeCache(t *testing.T) {
+	dbname := "test_cache." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	idx.SetCacheSize(1 << 20)
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := map[string][]float32{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("%d", i)
+		vecs[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vecs[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Search(vecs["1"], 5, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := g.CacheStats()
+	fmt.Printf("cache stats: %#v\n", stats)
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Entries == 0 {
+		t.Errorf("expected the second search to use the cache: %#v", stats)
+	}
+
+	//changing the returned vector must not change the cached one
+	v, err := g.GetVec(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v[0] += 100
+	if w, _ := g.GetVec(1); w[0] == v[0] {
+		t.Errorf("cached vector was changed through GetVec")
+	}
+
+	//replaced vectors and links are read again after the change, including
+	//through a second handle on the graph
+	h, err := idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("%d", i)
+		if _, err := h.Search(vecs[name], 5, 20); err != nil {
+			t.Fatal(err)
+		}
+		vecs[name] = randomVec(dim)
+		if err := g.Upsert([]byte(name), vecs[name]); err != nil {
+			t.Fatal(err)
+		}
+		out, err := h.Search(vecs[name], 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1 || string(out[0].Name) != name || out[0].Distance != 0 {
+			t.Errorf("upserted vector %s not found: %v", name, out)
+		}
+	}
+	for i := 20; i < 40; i++ {
+		name := fmt.Sprintf("%d", i)
+		if err := g.Delete([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		out, err := h.Search(vecs[name], 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) == 1 && string(out[0].Name) == name {
+			t.Errorf("deleted vector %s found", name)
+		}
+	}
+
+	//a small cache evicts old entries to stay within its size
+	idx.SetCacheSize(4096)
+	for name, v := range vecs {
+		if _, err := g.Search(v, 5, 20); err != nil {
+			t.Fatal(err)
+		}
+		if stats := g.CacheStats(); stats.Bytes > 4096 {
+			t.Fatalf("cache is over its size after searching %s: %#v", name, stats)
+		}
+	}
+	if stats := g.CacheStats(); stats.Evictions == 0 {
+		t.Errorf("expected evictions: %#v", stats)
+	}
+}
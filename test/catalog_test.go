@@ -0,0 +1,304 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func randomVec(dim int) []float32 {
+	c := make([]float32, dim)
+	for j := 0; j < dim; j++ {
+		c[j] = rand.Float32()
+	}
+	return c
+}
+
+func TestGraphCatalog(t *testing.T) {
+	dbname := "test_catalog." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dim := 10
+	g1, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := idx.NewGraph("graph2", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("a%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g1.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+		if err := g2.Insert([]byte(fmt.Sprintf("b%d", i)), randomVec(dim)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := idx.NewGraph("graph1", dim+1, 5, 10); err == nil {
+		t.Errorf("expected error when reopening graph with different parameters")
+	}
+	if _, err := idx.OpenGraph("missing"); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("expected ErrGraphNotFound, got %s", err)
+	}
+	idx.Close()
+
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	g1, err = idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := g1.Search(vmap["a10"], 10, 20)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(out) == 0 {
+		t.Errorf("no results from reopened graph")
+	}
+	for _, i := range out {
+		if _, ok := vmap[string(i.Name)]; !ok {
+			t.Errorf("result %s not from graph1", i.Name)
+		}
+	}
+
+	if _, err := idx.NewGraph("graph1", dim, 5, 10); err != nil {
+		t.Errorf("reopening graph with same parameters failed: %s", err)
+	}
+}
+
+func TestGraphManagement(t *testing.T) {
+	dbname := "test_catalog." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 8
+	for i, name := range []string{"graph1", "graph2"} {
+		g, err := idx.NewGraph(name, dim, 5, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 20*(i+1); j++ {
+			if err := g.Insert([]byte(fmt.Sprintf("%d", j)), randomVec(dim)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 2 {
+		t.Fatalf("expected 2 graphs, found %d", len(graphs))
+	}
+	for i, info := range graphs {
+		fmt.Printf("%#v\n", info)
+		if info.Count != uint64(20*(i+1)) {
+			t.Errorf("graph %s: expected %d vectors, found %d", info.Name, 20*(i+1), info.Count)
+		}
+		if info.Dim != dim || info.Config.M != 5 || info.Config.Mmax0 != 10 || info.Config.EfConstruction != 10 {
+			t.Errorf("graph %s: wrong parameters", info.Name)
+		}
+	}
+	if graphs[0].ID == graphs[1].ID {
+		t.Errorf("graphs share id %d", graphs[0].ID)
+	}
+
+	if err := idx.RenameGraph("graph1", "graph2"); err == nil {
+		t.Errorf("expected error renaming onto existing graph")
+	}
+	if err := idx.RenameGraph("graph1", "renamed"); err != nil {
+		t.Error(err)
+	}
+	if _, err := idx.OpenGraph("graph1"); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("old name still present after rename")
+	}
+	g, err := idx.OpenGraph("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.Search(randomVec(dim), 5, 10); err != nil || len(out) != 5 {
+		t.Errorf("search after rename failed: %d %v", len(out), err)
+	}
+
+	if err := idx.DropGraph("renamed"); err != nil {
+		t.Error(err)
+	}
+	if err := idx.DropGraph("renamed"); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("expected ErrGraphNotFound dropping missing graph, got %v", err)
+	}
+	graphs, err = idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 || graphs[0].Name != "graph2" || graphs[0].Count != 40 {
+		t.Errorf("unexpected graphs after drop: %#v", graphs)
+	}
+
+	g, err = idx.NewGraph("renamed", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.Search(randomVec(dim), 5, 10); err == nil && len(out) != 0 {
+		t.Errorf("recreated graph is not empty")
+	}
+}
+
+func TestGraphConfig(t *testing.T) {
+	dbname := "test_catalog." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := hnswindex.DefaultGraphConfig()
+	if def.M != 16 || def.Mmax0 != 32 || def.EfConstruction != 200 || def.Metric != hnswindex.EuclideanMetric {
+		t.Errorf("unexpected defaults: %#v", def)
+	}
+
+	config := hnswindex.GraphConfig{
+		M: 6, Mmax0: 20, EfConstruction: 40, ML: 0.5,
+		Metric: hnswindex.CosineMetric, KeepPrunedConnections: true,
+	}
+	dim := 8
+	g, err := idx.NewGraphWithConfig("graph1", dim, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Error(err)
+		}
+	}
+	if g.Config() != config {
+		t.Errorf("config not kept: %#v", g.Config())
+	}
+
+	if _, err := idx.NewGraphWithConfig("graph2", dim, hnswindex.GraphConfig{M: 8, Mmax0: 4}); err == nil {
+		t.Errorf("expected error for Mmax0 below M")
+	}
+	for _, d := range []int{0, -1} {
+		if _, err := idx.NewGraphWithConfig("graph3", d, hnswindex.GraphConfig{}); err == nil {
+			t.Errorf("expected error for dim=%d", d)
+		}
+	}
+	changed := config
+	changed.EfConstruction = 100
+	if _, err := idx.NewGraphWithConfig("graph1", dim, changed); err == nil {
+		t.Errorf("expected error when reopening graph with a different config")
+	}
+	idx.Close()
+
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	g, err = idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Config() != config {
+		t.Errorf("config not restored: %#v", g.Config())
+	}
+	if _, err := idx.NewGraphWithConfig("graph1", dim, config); err != nil {
+		t.Errorf("reopening graph with the same config failed: %s", err)
+	}
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 || graphs[0].Config != config {
+		t.Errorf("config not listed: %#v", graphs)
+	}
+}
+
+func TestDropGraphHandles(t *testing.T) {
+	dbname := "test_catalog." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { idx.Close() }()
+
+	dim := 4
+	a, err := idx.NewGraph("a", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Insert([]byte("x"), randomVec(dim)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.DropGraph("a"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := idx.NewGraph("b", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Insert([]byte("y"), randomVec(dim)); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("expected ErrGraphNotFound inserting into a dropped graph, got %v", err)
+	}
+	if err := a.Upsert([]byte("x"), randomVec(dim)); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("expected ErrGraphNotFound upserting into a dropped graph, got %v", err)
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 || graphs[0].Count != 0 || graphs[0].ID < 2 {
+		t.Errorf("graph id of a dropped graph was reused: %#v", graphs)
+	}
+	if out, err := b.Search(randomVec(dim), 5, 10); err != nil || len(out) != 0 {
+		t.Errorf("new graph is not empty: %v %v", out, err)
+	}
+
+	//the counter is persisted, so ids are not reused after reopening either
+	if err := idx.DropGraph("b"); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.NewGraph("c", dim, 5, 10); err != nil {
+		t.Fatal(err)
+	}
+	graphs, err = idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 || graphs[0].ID != 3 {
+		t.Errorf("expected graph id 3 after reopening, got %#v", graphs)
+	}
+}
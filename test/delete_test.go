@@ -0,0 +1,433 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestDelete(t *testing.T) {
+	dbname := "test_delete." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	names := []string{}
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("%d", i)
+		names = append(names, name)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the first name inserted is the entry point
+	deleted := map[string]bool{}
+	for i := 0; i < 200; i += 4 {
+		if err := g.Delete([]byte(names[i])); err != nil {
+			t.Error(err)
+		}
+		deleted[names[i]] = true
+	}
+
+	if err := g.Delete([]byte(names[0])); !errors.Is(err, hnswindex.ErrNameNotFound) {
+		t.Errorf("expected ErrNameNotFound, got %v", err)
+	}
+
+	for l := 0; l < 10; l++ {
+		for e := range g.ListLayer(uint8(l)) {
+			if e.Source%4 == 1 || e.Dest%4 == 1 {
+				t.Errorf("edge to deleted node remains: %d %d %d", l, e.Source, e.Dest)
+			}
+		}
+	}
+
+	found := 0
+	for k, v := range vmap {
+		if deleted[k] {
+			continue
+		}
+		out, err := g.Search(v, 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range out {
+			if deleted[string(n.Name)] {
+				t.Errorf("deleted vector %s returned from search", n.Name)
+			}
+		}
+		if len(out) > 0 && string(out[0].Name) == k {
+			found++
+		}
+	}
+	fmt.Printf("Self recall after delete: %d/%d\n", found, len(vmap)-len(deleted))
+	if found < (len(vmap)-len(deleted))*9/10 {
+		t.Errorf("recall after delete too low: %d", found)
+	}
+
+	for _, n := range names {
+		if !deleted[n] {
+			if err := g.Delete([]byte(n)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	out, err := g.Search(randomVec(dim), 5, 20)
+	if err != nil || len(out) != 0 {
+		t.Errorf("expected empty graph: %d %v", len(out), err)
+	}
+}
+
+func TestMarkDeleted(t *testing.T) {
+	dbname := "test_delete." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deleted := map[string]bool{}
+	for i := 0; i < 200; i += 3 {
+		name := fmt.Sprintf("%d", i)
+		if err := g.MarkDeleted([]byte(name)); err != nil {
+			t.Error(err)
+		}
+		deleted[name] = true
+	}
+	if err := g.MarkDeleted([]byte("missing")); !errors.Is(err, hnswindex.ErrNameNotFound) {
+		t.Errorf("expected ErrNameNotFound, got %v", err)
+	}
+
+	for k, v := range vmap {
+		out, err := g.Search(v, 10, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 10 {
+			t.Errorf("expected 10 results, got %d", len(out))
+		}
+		for _, n := range out {
+			if deleted[string(n.Name)] {
+				t.Errorf("search for %s returned deleted vector %s", k, n.Name)
+			}
+		}
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Deleted != uint64(len(deleted)) {
+		t.Errorf("expected %d deleted, found %d", len(deleted), graphs[0].Deleted)
+	}
+
+	if err := g.Insert([]byte("3"), vmap["3"]); !errors.Is(err, hnswindex.ErrDuplicateName) {
+		t.Errorf("expected ErrDuplicateName for tombstoned name, got %v", err)
+	}
+	if err := g.Upsert([]byte("3"), vmap["3"]); err != nil {
+		t.Error(err)
+	}
+	out, err := g.Search(vmap["3"], 1, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || string(out[0].Name) != "3" {
+		t.Errorf("upserted vector not returned after tombstone: %v", out)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	dbname := "test_delete." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deleted := map[string]bool{}
+	for i := 0; i < 300; i += 3 {
+		name := fmt.Sprintf("%d", i)
+		if err := g.MarkDeleted([]byte(name)); err != nil {
+			t.Error(err)
+		}
+		deleted[name] = true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.Vacuum(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// search while the vacuum runs
+	done := make(chan bool)
+	searchErrs := make(chan error, 1)
+	go func() {
+		defer close(searchErrs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			out, err := g.Search(randomVec(dim), 5, 20)
+			if err != nil {
+				searchErrs <- err
+				return
+			}
+			for _, n := range out {
+				if deleted[string(n.Name)] {
+					searchErrs <- fmt.Errorf("deleted vector %s returned", n.Name)
+					return
+				}
+			}
+		}
+	}()
+
+	stats, err := g.Vacuum(context.Background())
+	close(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-searchErrs; err != nil {
+		t.Errorf("search during vacuum: %s", err)
+	}
+	fmt.Printf("Vacuum: %#v\n", stats)
+	if stats.Nodes != len(deleted) || stats.Edges == 0 {
+		t.Errorf("unexpected vacuum stats: %#v", stats)
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != uint64(300-len(deleted)) || graphs[0].Deleted != 0 {
+		t.Errorf("unexpected graph counts after vacuum: %#v", graphs[0])
+	}
+
+	for l := 0; l < 10; l++ {
+		for e := range g.ListLayer(uint8(l)) {
+			if e.Source%3 == 1 || e.Dest%3 == 1 {
+				t.Errorf("edge to vacuumed node remains: %d %d %d", l, e.Source, e.Dest)
+			}
+		}
+	}
+
+	found := 0
+	for k, v := range vmap {
+		if deleted[k] {
+			continue
+		}
+		out, err := g.Search(v, 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == k {
+			found++
+		}
+	}
+	fmt.Printf("Self recall after vacuum: %d/%d\n", found, 300-len(deleted))
+	if found < (300-len(deleted))*9/10 {
+		t.Errorf("recall after vacuum too low: %d", found)
+	}
+}
+
+func TestVacuumUpsert(t *testing.T) {
+	dbname := "test_delete." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	idx.SetSync(false)
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 300; i += 2 {
+		if err := g.MarkDeleted([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replace deleted vectors while the vacuum runs, in the order it removes
+	// them, so some are replaced after their tombstones were listed
+	upserted := map[string][]float32{}
+	upsertErrs := make(chan error, 1)
+	go func() {
+		defer close(upsertErrs)
+		for i := 0; i < 300; i += 4 {
+			name := fmt.Sprintf("%d", i)
+			vec := randomVec(dim)
+			if err := g.Upsert([]byte(name), vec); err != nil {
+				upsertErrs <- err
+				return
+			}
+			upserted[name] = vec
+		}
+	}()
+	stats, err := g.Vacuum(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-upsertErrs; err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("Vacuum during upserts: %#v\n", stats)
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != uint64(150+len(upserted)) || graphs[0].Deleted != 0 {
+		t.Errorf("upserted vectors were vacuumed: %#v", graphs[0])
+	}
+	if stats.Nodes > 150 {
+		t.Errorf("unexpected vacuum stats: %#v", stats)
+	}
+	found := 0
+	for name, vec := range upserted {
+		out, err := g.Search(vec, 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == name {
+			found++
+		}
+	}
+	fmt.Printf("Self recall of vectors upserted during vacuum: %d/%d\n", found, len(upserted))
+	if found < len(upserted)*9/10 {
+		t.Errorf("recall of upserted vectors too low: %d/%d", found, len(upserted))
+	}
+}
+
+func TestConcurrentDelete(t *testing.T) {
+	dbname := "test_delete." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	idx.SetSync(false)
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every name is deleted by two goroutines at once, and inserted again
+	// by one of them, so only one delete of each insert may succeed
+	var deleted, reinserted atomic.Int64
+	wg := sync.WaitGroup{}
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := []byte(fmt.Sprintf("%d", i))
+				err := g.Delete(name)
+				if errors.Is(err, hnswindex.ErrNameNotFound) {
+					continue
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				deleted.Add(1)
+				if w == 0 && i%2 == 0 {
+					if err := g.Insert(name, randomVec(dim)); err == nil {
+						reinserted.Add(1)
+					} else if !errors.Is(err, hnswindex.ErrDuplicateName) {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(graphs[0].Count) != 100-deleted.Load()+reinserted.Load() {
+		t.Errorf("%d deleted and %d inserted again, but %d vectors left", deleted.Load(), reinserted.Load(), graphs[0].Count)
+	}
+	for l := 0; l < 10; l++ {
+		for e := range g.ListLayer(uint8(l)) {
+			for _, id := range []uint64{e.Source, e.Dest} {
+				if _, err := g.GetVec(id); err != nil {
+					t.Errorf("edge %d -> %d in layer %d links a deleted node", e.Source, e.Dest, l)
+				}
+			}
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package test
 
 import (
+	"cmp"
 	"fmt"
+	"math/rand"
+	"slices"
 	"testing"
 
 	"github.com/bmeg/hnsw-index/distqueue"
@@ -21,8 +24,16 @@ func TestDistMinCappedQueue(t *testing.T) {
 	d.Insert(5.0, 5)
 	d.Insert(8.0, 8)
 
-	for _, i := range d {
+	out := []int{}
+	for _, i := range d.Ascending() {
 		fmt.Printf("%f %d\n", i.Dist, i.Value)
+		out = append(out, i.Value)
+	}
+	if !slices.Equal(out, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("unexpected queue contents: %v", out)
+	}
+	if !d.Filled() || d.Max() != 5.0 {
+		t.Errorf("expected a full queue with max 5, got %v %f", d.Filled(), d.Max())
 	}
 }
 
@@ -40,7 +51,127 @@ func TestDistMaxQueue(t *testing.T) {
 	d.Insert(5.0, 5)
 	d.Insert(8.0, 8)
 
-	for _, i := range d {
+	for _, i := range d.Descending() {
 		fmt.Printf("%f %d\n", i.Dist, i.Value)
 	}
+	if dist, v := d.Peek(); dist != 10.0 || v != 10 {
+		t.Errorf("expected to peek 10, got %f %d", dist, v)
+	}
+	for want := 10; want > 0; want-- {
+		if _, v := d.Pop(); v != want {
+			t.Errorf("expected to pop %d, got %d", want, v)
+		}
+	}
+	if len(d) != 0 {
+		t.Errorf("expected an empty queue, %d left", len(d))
+	}
+}
+
+func TestDistQueueOrder(t *testing.T) {
+	min := distqueue.NewMin[float32, int]()
+	max := distqueue.NewMax[float32, int]()
+	capped := distqueue.NewMinCapped[float32, int](50)
+	dists := []float32{}
+	for i := 0; i < 1000; i++ {
+		d := rand.Float32()
+		dists = append(dists, d)
+		min.Insert(d, i)
+		max.Insert(d, i)
+		capped.Insert(d, i)
+		//pops mixed in with inserts
+		if i%7 == 0 {
+			d, _ := min.Peek()
+			if p, _ := min.Pop(); p != d {
+				t.Fatalf("popped %f after peeking %f", p, d)
+			}
+			idx := slices.Index(dists, d)
+			dists = slices.Delete(dists, idx, idx+1)
+			min.Insert(d, i)
+			dists = append(dists, d)
+		}
+	}
+	slices.Sort(dists)
+
+	for i, e := range min.Ascending() {
+		if e.Dist != dists[i] {
+			t.Fatalf("min queue sorted out of order at %d", i)
+		}
+	}
+	for i, e := range max.Descending() {
+		if e.Dist != dists[len(dists)-1-i] {
+			t.Fatalf("max queue sorted out of order at %d", i)
+		}
+	}
+	for i, e := range capped.Ascending() {
+		if e.Dist != dists[i] {
+			t.Fatalf("capped queue sorted out of order at %d", i)
+		}
+	}
+	if !slices.Equal(min.Sorted(), min.Ascending()) || !slices.Equal(max.Sorted(), max.Ascending()) ||
+		!slices.Equal(capped.Sorted(), capped.Ascending()) {
+		t.Errorf("Sorted does not match Ascending")
+	}
+	if capped.Max() != dists[49] {
+		t.Errorf("capped queue max %f, expected %f", capped.Max(), dists[49])
+	}
+	for i := range dists {
+		if d, _ := min.Pop(); d != dists[i] {
+			t.Fatalf("min queue popped %f at %d, expected %f", d, i, dists[i])
+		}
+	}
+}
+
+func TestDistQueueFromSlice(t *testing.T) {
+	elems := []distqueue.Element[float32, int]{}
+	for i := 0; i < 500; i++ {
+		elems = append(elems, distqueue.Element[float32, int]{Dist: rand.Float32(), Value: i})
+	}
+	ascending := slices.Clone(elems)
+	slices.SortFunc(ascending, func(a, b distqueue.Element[float32, int]) int {
+		return cmp.Compare(a.Dist, b.Dist)
+	})
+
+	min := distqueue.MinFromSlice(slices.Clone(elems))
+	max := distqueue.MaxFromSlice(slices.Clone(elems))
+	capped := distqueue.MinCappedFromSlice(20, elems)
+	small := distqueue.MinCappedFromSlice(1000, elems)
+	if !capped.Filled() || len(small) != len(elems) || small.Filled() {
+		t.Errorf("unexpected capped queue sizes: %d %d", len(capped), len(small))
+	}
+	for i := range ascending {
+		if d, _ := min.Pop(); d != ascending[i].Dist {
+			t.Fatalf("min queue popped %f at %d, expected %f", d, i, ascending[i].Dist)
+		}
+		if d, _ := max.Pop(); d != ascending[len(ascending)-1-i].Dist {
+			t.Fatalf("max queue popped %f at %d", d, i)
+		}
+	}
+	if !slices.Equal(capped.Ascending(), ascending[:20]) {
+		t.Errorf("capped queue does not hold the nearest elements")
+	}
+	desc := small.Descending()
+	for i := range desc {
+		if desc[i] != ascending[len(ascending)-1-i] {
+			t.Fatalf("descending order wrong at %d", i)
+		}
+	}
+}
+
+func TestMergeMinCapped(t *testing.T) {
+	all := []distqueue.Element[float32, int]{}
+	shards := []distqueue.DistQueueMinCapped[float32, int]{}
+	for s := 0; s < 4; s++ {
+		q := distqueue.NewMinCapped[float32, int](10)
+		for i := 0; i < 100; i++ {
+			e := distqueue.Element[float32, int]{Dist: rand.Float32(), Value: s*100 + i}
+			all = append(all, e)
+			q.Insert(e.Dist, e.Value)
+		}
+		shards = append(shards, q)
+	}
+	merged := distqueue.MergeMinCapped(10, shards...)
+	expected := distqueue.MinCappedFromSlice(10, all)
+	if !slices.Equal(merged.Ascending(), expected.Ascending()) {
+		t.Errorf("merged queue differs from the global top 10")
+	}
 }
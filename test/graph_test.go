@@ -1,9 +1,12 @@
 package test
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	hnswindex "github.com/bmeg/hnsw-index"
@@ -76,15 +79,727 @@ func TestInsert(t *testing.T) {
 		t.Error(err)
 	}
 
-	for _, i := range out {
-		fmt.Printf("search: out: %s\n", i)
+	for j, i := range out {
+		fmt.Printf("search: out: %s %f\n", i.Name, i.Distance)
+		if d := hnswindex.Euclidean(vmap[string(i.Name)], qVec); d != i.Distance {
+			t.Errorf("wrong distance for %s: %f %f", i.Name, i.Distance, d)
+		}
+		if j > 0 && out[j-1].Distance > i.Distance {
+			t.Errorf("results out of order: %f %f", out[j-1].Distance, i.Distance)
+		}
+		if v, err := g.GetVec(i.ID); err != nil || hnswindex.Euclidean(v, vmap[string(i.Name)]) != 0 {
+			t.Errorf("result id %d does not match vector %s", i.ID, i.Name)
+		}
 	}
 
-	for i := 0; i < 10; i++ {
-		fmt.Printf("scan out: %s\n", testDists[i].Value)
+	for _, e := range testDists.Ascending()[:10] {
+		fmt.Printf("scan out: %s\n", e.Value)
 	}
 
 	idx.Close()
 	os.RemoveAll(dbname)
 
 }
+
+func TestUpsert(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := g.Insert([]byte("5"), randomVec(dim)); !errors.Is(err, hnswindex.ErrDuplicateName) {
+		t.Errorf("expected ErrDuplicateName, got %v", err)
+	}
+
+	// replace a regular node and the entry point
+	for _, name := range []string{"5", "0"} {
+		nVec := randomVec(dim)
+		if err := g.Upsert([]byte(name), nVec); err != nil {
+			t.Fatal(err)
+		}
+		out, err := g.Search(nVec, 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1 || string(out[0].Name) != name {
+			t.Errorf("upserted vector %s not found: %v", name, out)
+		}
+	}
+
+	if err := g.Upsert([]byte("new"), randomVec(dim)); err != nil {
+		t.Error(err)
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 101 {
+		t.Errorf("expected 101 vectors after upsert, found %d", graphs[0].Count)
+	}
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	idx.SetSync(false)
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replace the same names from several goroutines at once
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := g.Upsert([]byte(fmt.Sprintf("%d", i%4)), randomVec(dim)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// every edge must have been built for the vectors now stored
+	metric := g.Config().Metric
+	for l := 0; l < 10; l++ {
+		for e := range g.ListLayer(uint8(l)) {
+			src, err := g.GetVec(e.Source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := g.GetVec(e.Dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := metric.Distance(src, dst); d != e.Dist {
+				t.Errorf("edge %d -> %d in layer %d has distance %f, vectors are %f apart", e.Source, e.Dest, l, e.Dist, d)
+			}
+		}
+	}
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 100 {
+		t.Errorf("expected 100 vectors after upserts, found %d", graphs[0].Count)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	vmap := map[string][]float32{}
+	for i := 0; i < 300; i++ {
+		c := make([]float32, dim)
+		for j := range c {
+			c[j] = rand.Float32() - 0.5
+		}
+		vmap[fmt.Sprintf("%d", i)] = c
+	}
+	query := randomVec(dim)
+
+	metrics := []hnswindex.Metric{hnswindex.CosineMetric, hnswindex.InnerProductMetric,
+		hnswindex.ManhattanMetric, hnswindex.SquaredL2Metric}
+	for _, m := range metrics {
+		g, err := idx.NewGraphWithMetric("graph_"+m.Name(), dim, 5, 20, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range vmap {
+			if err := g.Insert([]byte(k), v); err != nil {
+				t.Error(err)
+			}
+		}
+		scan := distqueue.NewMin[float32, string]()
+		for k, v := range vmap {
+			scan.Insert(m.Distance(query, v), k)
+		}
+		nearest := scan.Ascending()
+		expected := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			expected[nearest[i].Value] = true
+		}
+
+		out, err := g.Search(query, 10, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for _, r := range out {
+			if d := m.Distance(query, vmap[string(r.Name)]); d != r.Distance {
+				t.Errorf("%s: wrong distance for %s: %f %f", m.Name(), r.Name, r.Distance, d)
+			}
+			if expected[string(r.Name)] {
+				found++
+			}
+		}
+		fmt.Printf("%s recall: %d/10\n", m.Name(), found)
+		if found < 7 {
+			t.Errorf("%s: recall too low: %d", m.Name(), found)
+		}
+	}
+
+	if _, err := idx.NewGraphWithMetric("graph_cosine", dim, 5, 20, hnswindex.EuclideanMetric); err == nil {
+		t.Errorf("expected error reopening graph with different metric")
+	}
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range graphs {
+		if g.Name != "graph_"+g.Metric {
+			t.Errorf("graph %s has metric %s", g.Name, g.Metric)
+		}
+	}
+}
+
+func TestSearchFiltered(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmap := map[string][]float32{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// only allow one in ten vectors
+	filter := func(id uint64, name []byte) bool {
+		return strings.HasSuffix(string(name), "7")
+	}
+	query := randomVec(dim)
+	scan := distqueue.NewMin[float32, string]()
+	for k, v := range vmap {
+		if filter(0, []byte(k)) {
+			scan.Insert(hnswindex.Euclidean(query, v), k)
+		}
+	}
+	nearest := scan.Ascending()
+	expected := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		expected[nearest[i].Value] = true
+	}
+
+	out, err := g.SearchFiltered(query, 5, 30, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 5 {
+		t.Errorf("expected 5 results, got %d", len(out))
+	}
+	found := 0
+	for _, r := range out {
+		if !filter(r.ID, r.Name) {
+			t.Errorf("filtered search returned %s", r.Name)
+		}
+		if expected[string(r.Name)] {
+			found++
+		}
+	}
+	fmt.Printf("filtered recall: %d/5\n", found)
+	if found < 4 {
+		t.Errorf("filtered recall too low: %d", found)
+	}
+}
+
+func TestSearchArgs(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 4
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accept := func(id uint64, name []byte) bool { return true }
+	for _, tc := range []struct {
+		vec   []float32
+		K, ef int
+	}{
+		{randomVec(40), 5, 10},
+		{randomVec(2), 5, 10},
+		{randomVec(dim), 5, 0},
+		{randomVec(dim), 0, 10},
+		{randomVec(dim), -1, 10},
+	} {
+		if _, err := g.Search(tc.vec, tc.K, tc.ef); err == nil {
+			t.Errorf("expected an error searching %d dims with K=%d ef=%d", len(tc.vec), tc.K, tc.ef)
+		}
+		if _, err := g.SearchFiltered(tc.vec, tc.K, tc.ef, accept); err == nil {
+			t.Errorf("expected an error from SearchFiltered with %d dims K=%d ef=%d", len(tc.vec), tc.K, tc.ef)
+		}
+	}
+
+	// ef is raised to K
+	out, err := g.Search(randomVec(dim), 20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 20 {
+		t.Errorf("expected 20 results with ef below K, got %d", len(out))
+	}
+}
+
+func TestLevels(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmap := map[string][]float32{}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// each layer should have about 1/M of the nodes of the layer below
+	counts := []int{}
+	for l := 0; ; l++ {
+		sources := map[uint64]bool{}
+		for e := range g.ListLayer(uint8(l)) {
+			sources[e.Source] = true
+		}
+		if len(sources) == 0 {
+			break
+		}
+		counts = append(counts, len(sources))
+	}
+	fmt.Printf("nodes per layer: %v\n", counts)
+	if len(counts) < 3 {
+		t.Errorf("expected at least 3 populated layers: %v", counts)
+	} else if counts[1] < 100 || counts[1] > 350 {
+		t.Errorf("unexpected number of nodes in layer 1: %v", counts)
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] > counts[i-1] {
+			t.Errorf("layer %d larger than layer below: %v", i, counts)
+		}
+	}
+
+	found := 0
+	for q := 0; q < 20; q++ {
+		query := randomVec(dim)
+		scan := distqueue.NewMin[float32, string]()
+		for k, v := range vmap {
+			scan.Insert(hnswindex.Euclidean(query, v), k)
+		}
+		nearest := scan.Ascending()
+		expected := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			expected[nearest[i].Value] = true
+		}
+		out, err := g.Search(query, 10, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range out {
+			if expected[string(r.Name)] {
+				found++
+			}
+		}
+	}
+	fmt.Printf("recall: %d/200\n", found)
+	if found < 160 {
+		t.Errorf("recall too low: %d/200", found)
+	}
+}
+
+func TestNeighborLimits(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	M := 4
+	checkDegrees := func(g *hnswindex.Graph) {
+		for l := 0; l < 8; l++ {
+			limit := M
+			if l == 0 {
+				limit = 2 * M
+			}
+			degree := map[uint64]int{}
+			for e := range g.ListLayer(uint8(l)) {
+				degree[e.Source]++
+			}
+			for n, d := range degree {
+				if d > limit {
+					t.Errorf("node %d has %d friends in layer %d, limit %d", n, d, l, limit)
+				}
+			}
+		}
+	}
+
+	for _, opts := range [][2]bool{{false, false}, {true, true}} {
+		g, err := idx.NewGraphWithConfig(fmt.Sprintf("graph_%v_%v", opts[0], opts[1]), dim, hnswindex.GraphConfig{
+			M: M, EfConstruction: 20, ExtendCandidates: opts[0], KeepPrunedConnections: opts[1],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vmap := map[string][]float32{}
+		for i := 0; i < 500; i++ {
+			name := fmt.Sprintf("%d", i)
+			vmap[name] = randomVec(dim)
+			if err := g.Insert([]byte(name), vmap[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkDegrees(g)
+
+		found := 0
+		for k, v := range vmap {
+			out, err := g.Search(v, 1, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) > 0 && string(out[0].Name) == k {
+				found++
+			}
+		}
+		fmt.Printf("self recall %v: %d/%d\n", opts, found, len(vmap))
+		if found < len(vmap)*9/10 {
+			t.Errorf("self recall too low %v: %d/%d", opts, found, len(vmap))
+		}
+
+		for i := 0; i < 500; i += 5 {
+			if err := g.Delete([]byte(fmt.Sprintf("%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkDegrees(g)
+	}
+}
+
+func TestConcurrentInsert(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	M := 5
+	g, err := idx.NewGraph("graph1", dim, uint8(M), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workers := 8
+	perWorker := 100
+	vecs := make([][]float32, workers*perWorker)
+	for i := range vecs {
+		vecs[i] = randomVec(dim)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			//a second handle on the same graph, to check locks are shared
+			h, err := idx.OpenGraph("graph1")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := w * perWorker; i < (w+1)*perWorker; i++ {
+				if err := h.Insert([]byte(fmt.Sprintf("%d", i)), vecs[i]); err != nil {
+					errs <- err
+				}
+				if i%10 == 0 {
+					if _, err := h.Search(vecs[i], 5, 20); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+	//all workers race to insert the same name
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.Insert([]byte("shared"), randomVec(dim)); err != nil && !errors.Is(err, hnswindex.ErrDuplicateName) {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != uint64(len(vecs)+1) {
+		t.Errorf("expected %d vectors, found %d", len(vecs)+1, graphs[0].Count)
+	}
+
+	ids := map[uint64]bool{}
+	found := 0
+	for i, v := range vecs {
+		out, err := g.Search(v, 1, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == fmt.Sprintf("%d", i) {
+			found++
+			if ids[out[0].ID] {
+				t.Errorf("id %d used twice", out[0].ID)
+			}
+			ids[out[0].ID] = true
+		}
+	}
+	fmt.Printf("self recall after concurrent insert: %d/%d\n", found, len(vecs))
+	if found < len(vecs)*9/10 {
+		t.Errorf("self recall too low: %d/%d", found, len(vecs))
+	}
+
+	for l := 0; l < 8; l++ {
+		limit := M
+		if l == 0 {
+			limit = 2 * M
+		}
+		degree := map[uint64]int{}
+		for e := range g.ListLayer(uint8(l)) {
+			degree[e.Source]++
+		}
+		for n, d := range degree {
+			if d > limit {
+				t.Errorf("node %d has %d friends in layer %d, limit %d", n, d, l, limit)
+			}
+		}
+	}
+}
+
+func TestIDCounter(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dim := 8
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmap := map[string][]float32{}
+	insert := func(g *hnswindex.Graph, name string) {
+		vmap[name] = randomVec(dim)
+		if err := g.Insert([]byte(name), vmap[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idOf := func(g *hnswindex.Graph, name string) uint64 {
+		out, err := g.Search(vmap[name], 1, 20)
+		if err != nil || len(out) == 0 || string(out[0].Name) != name {
+			t.Fatalf("%s not found: %v", name, err)
+		}
+		return out[0].ID
+	}
+
+	used := map[uint64]bool{}
+	maxID := uint64(0)
+	for i := 0; i < 20; i++ {
+		insert(g, fmt.Sprintf("a%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		id := idOf(g, fmt.Sprintf("a%d", i))
+		used[id] = true
+		maxID = max(maxID, id)
+	}
+	if err := g.Delete([]byte("a19")); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	g, err = idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		insert(g, fmt.Sprintf("b%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		id := idOf(g, fmt.Sprintf("b%d", i))
+		if used[id] || id <= maxID {
+			t.Errorf("id %d reused after reopening", id)
+		}
+		used[id] = true
+	}
+}
+
+func TestInsertNoSync(t *testing.T) {
+	dbname := "test_index." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SetSync(false)
+
+	dim := 8
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmap := map[string][]float32{}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		if err := g.InsertWithPayload([]byte(name), vmap[name], hnswindex.Payload{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a payload that can't be encoded must not leave a partial insert
+	if err := g.InsertWithPayload([]byte("bad"), randomVec(dim), hnswindex.Payload{"f": func() {}}); err == nil {
+		t.Errorf("expected error for unencodable payload")
+	}
+	idx.Close()
+
+	idx, err = hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	g, err = idx.OpenGraph("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 100 {
+		t.Errorf("expected 100 vectors, found %d", graphs[0].Count)
+	}
+	found := 0
+	for name, v := range vmap {
+		if p, err := g.GetPayload([]byte(name)); err != nil {
+			t.Errorf("%s not found after reopening: %s", name, err)
+		} else if p == nil {
+			t.Errorf("%s payload not stored", name)
+		}
+		out, err := g.Search(v, 1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 && string(out[0].Name) == name {
+			found++
+		}
+	}
+	//with M=5 a node can occasionally be left unreachable from the entry
+	//point, so search recall isn't exact
+	if found < 95 {
+		t.Errorf("self recall too low after reopening: %d/100", found)
+	}
+}
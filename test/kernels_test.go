@@ -0,0 +1,65 @@
+package test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestDistanceKernels(t *testing.T) {
+	defer hnswindex.SetDistanceKernel(hnswindex.DistanceKernel())
+	fmt.Printf("distance kernels: %v\n", hnswindex.DistanceKernels())
+
+	near := func(a, b float32) bool {
+		return math.Abs(float64(a-b)) <= 1e-4*math.Max(1, math.Abs(float64(b)))
+	}
+	for _, kernel := range hnswindex.DistanceKernels() {
+		for dim := 0; dim <= 130; dim++ {
+			a, b := randomVec(dim), randomVec(dim+3)
+			if err := hnswindex.SetDistanceKernel("generic"); err != nil {
+				t.Fatal(err)
+			}
+			l2, dot, cos := hnswindex.SquaredEuclidean(a, b), hnswindex.Dot(a, b), hnswindex.CosineDistance(a, b)
+			if err := hnswindex.SetDistanceKernel(kernel); err != nil {
+				t.Fatal(err)
+			}
+			if d := hnswindex.SquaredEuclidean(a, b); !near(d, l2) {
+				t.Errorf("%s squared L2 of %d dims: %f, expected %f", kernel, dim, d, l2)
+			}
+			if d := hnswindex.Dot(a, b); !near(d, dot) {
+				t.Errorf("%s dot of %d dims: %f, expected %f", kernel, dim, d, dot)
+			}
+			if d := hnswindex.CosineDistance(a, b); !near(d, cos) {
+				t.Errorf("%s cosine of %d dims: %f, expected %f", kernel, dim, d, cos)
+			}
+			if d := hnswindex.Euclidean(a, a); d != 0 {
+				t.Errorf("%s distance of a vector to itself: %f", kernel, d)
+			}
+		}
+	}
+	if err := hnswindex.SetDistanceKernel("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown kernel")
+	}
+}
+
+func BenchmarkDistance(b *testing.B) {
+	defer hnswindex.SetDistanceKernel(hnswindex.DistanceKernel())
+	metrics := []hnswindex.Metric{hnswindex.SquaredL2Metric, hnswindex.InnerProductMetric, hnswindex.CosineMetric}
+	for _, kernel := range hnswindex.DistanceKernels() {
+		for _, m := range metrics {
+			for _, dim := range []int{16, 128, 768} {
+				x, y := randomVec(dim), randomVec(dim)
+				b.Run(fmt.Sprintf("%s/%s/%d", kernel, m.Name(), dim), func(b *testing.B) {
+					if err := hnswindex.SetDistanceKernel(kernel); err != nil {
+						b.Fatal(err)
+					}
+					for i := 0; i < b.N; i++ {
+						m.Distance(x, y)
+					}
+				})
+			}
+		}
+	}
+}
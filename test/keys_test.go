@@ -1,6 +1,7 @@
 package test
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
@@ -38,7 +39,7 @@ func TestLayerOrder(t *testing.T) {
 
 	for k, vs := range data {
 		for _, v := range vs {
-			key := hnswindex.LayerKeyEncode(1, 2, k, v)
+			key := hnswindex.LayerKeyEncode(1, 2, k, v, 0)
 			db.Set(key, []byte{}, nil)
 		}
 	}
@@ -89,3 +90,29 @@ func TestVecEncoder(t *testing.T) {
 		}
 	}
 }
+
+func TestLayerKeyNegativeDist(t *testing.T) {
+	dists := []float32{-1000.5, -3.0, -1.0, -0.25, 0.0, 0.5, 2.0, 3000.0}
+	var last []byte
+	for _, d := range dists {
+		key := hnswindex.LayerKeyEncode(1, 0, 5, d, 0)
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			t.Errorf("key for %f not sorted after previous", d)
+		}
+		if _, _, _, pd := hnswindex.LayerKeyParse(key); pd != d {
+			t.Errorf("distance not decoded correctly: %f %f", d, pd)
+		}
+		last = key
+	}
+}
+
+func TestLayerKeyTiedDist(t *testing.T) {
+	a := hnswindex.LayerKeyEncode(1, 0, 5, 1.5, 7)
+	b := hnswindex.LayerKeyEncode(1, 0, 5, 1.5, 9)
+	if bytes.Equal(a, b) {
+		t.Errorf("edges at the same distance share a key")
+	}
+	if _, _, src, d := hnswindex.LayerKeyParse(b); src != 5 || d != 1.5 {
+		t.Errorf("key not decoded correctly: %d %f", src, d)
+	}
+}
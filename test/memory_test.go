@@ -0,0 +1,221 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+)
+
+func TestLoadGraphInMemory(t *testing.T) {
+	dbname := "test_memory." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	disk, err := idx.NewGraph("graph1", dim, 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := map[string][]float32{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("%d", i)
+		vecs[name] = randomVec(dim)
+		if err := disk.Insert([]byte(name), vecs[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := idx.LoadGraphInMemory("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		v := randomVec(dim)
+		a, err := disk.Search(v, 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := g.Search(v, 5, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a) != len(b) {
+			t.Fatalf("in memory search found %d results, on disk %d", len(b), len(a))
+		}
+		for j := range a {
+			if a[j].ID != b[j].ID {
+				t.Errorf("in memory search differs from disk: %v %v", b, a)
+				break
+			}
+		}
+	}
+
+	//writes and searches run alongside each other
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				v := randomVec(dim)
+				if err := g.Insert([]byte(fmt.Sprintf("new-%d-%d", w, i)), v); err != nil {
+					errs <- err
+				}
+				if _, err := g.Search(v, 5, 20); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	vecs["1"] = randomVec(dim)
+	if err := g.Upsert([]byte("1"), vecs["1"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Delete([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.MarkDeleted([]byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPayload([]byte("4"), hnswindex.Payload{"color": "red"}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.Search(vecs["1"], 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || string(out[0].Name) != "1" || out[0].Distance != 0 {
+		t.Errorf("upserted vector not found in memory: %v", out)
+	}
+
+	//nothing reaches the disk until a snapshot
+	graphs, err := idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 300 {
+		t.Errorf("expected 300 vectors on disk before snapshot, found %d", graphs[0].Count)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	graphs, err = idx.ListGraphs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graphs[0].Count != 499 || graphs[0].Deleted != 1 {
+		t.Errorf("expected 499 vectors and 1 deleted after snapshot, found %d and %d", graphs[0].Count, graphs[0].Deleted)
+	}
+	out, err = disk.Search(vecs["1"], 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || string(out[0].Name) != "1" || out[0].Distance != 0 {
+		t.Errorf("upserted vector not found on disk: %v", out)
+	}
+	if _, err := disk.GetPayload([]byte("2")); !errors.Is(err, hnswindex.ErrNameNotFound) {
+		t.Errorf("expected deleted vector to be gone, got %v", err)
+	}
+	if p, err := disk.GetPayload([]byte("4")); err != nil || p["color"] != "red" {
+		t.Errorf("payload not written back: %v %v", p, err)
+	}
+	if err := disk.Insert([]byte("after"), randomVec(dim)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySnapshotInterval(t *testing.T) {
+	dbname := "test_memory." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 8
+	if _, err := idx.NewGraph("graph1", dim, 5, 20); err != nil {
+		t.Fatal(err)
+	}
+	g, err := idx.LoadGraphInMemoryWithOptions("graph1", hnswindex.MemoryOptions{
+		SnapshotInterval: 20 * time.Millisecond,
+		SnapshotError:    func(err error) { t.Error(err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for i := 0; i < 50; i++ {
+		if err := g.Insert([]byte(fmt.Sprintf("%d", i)), randomVec(dim)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		graphs, err := idx.ListGraphs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if graphs[0].Count == 50 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("periodic snapshot did not run, found %d vectors on disk", graphs[0].Count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryDropGraph(t *testing.T) {
+	dbname := "test_memory." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 8
+	if _, err := idx.NewGraph("graph1", dim, 5, 20); err != nil {
+		t.Fatal(err)
+	}
+	g, err := idx.LoadGraphInMemory("graph1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Insert([]byte("a"), randomVec(dim)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.DropGraph("graph1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Insert([]byte("b"), randomVec(dim)); !errors.Is(err, hnswindex.ErrGraphNotFound) {
+		t.Errorf("expected ErrGraphNotFound inserting into a dropped graph, got %v", err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("second close: %s", err)
+	}
+}
@@ -0,0 +1,222 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	hnswindex "github.com/bmeg/hnsw-index"
+	"github.com/bmeg/hnsw-index/distqueue"
+)
+
+func TestPayload(t *testing.T) {
+	dbname := "test_payload." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := map[string][]float32{}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		var p hnswindex.Payload
+		if i%2 == 0 {
+			p = hnswindex.Payload{"sample": name, "age": i}
+		}
+		if err := g.InsertWithPayload([]byte(name), vmap[name], p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	out, err := g.Search(vmap["10"], 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range out {
+		var i int
+		fmt.Sscanf(string(r.Name), "%d", &i)
+		if i%2 == 0 {
+			if r.Payload == nil || r.Payload["sample"] != string(r.Name) || r.Payload["age"] != float64(i) {
+				t.Errorf("wrong payload for %s: %#v", r.Name, r.Payload)
+			}
+		} else if r.Payload != nil {
+			t.Errorf("unexpected payload for %s: %#v", r.Name, r.Payload)
+		}
+	}
+
+	if err := g.SetPayload([]byte("1"), hnswindex.Payload{"sample": "updated"}); err != nil {
+		t.Error(err)
+	}
+	if p, err := g.GetPayload([]byte("1")); err != nil || p["sample"] != "updated" {
+		t.Errorf("payload not updated: %#v %v", p, err)
+	}
+	if err := g.Upsert([]byte("1"), randomVec(dim)); err != nil {
+		t.Error(err)
+	}
+	if p, err := g.GetPayload([]byte("1")); err != nil || p["sample"] != "updated" {
+		t.Errorf("payload not kept by upsert: %#v %v", p, err)
+	}
+	if err := g.UpsertWithPayload([]byte("1"), randomVec(dim), nil); err != nil {
+		t.Error(err)
+	}
+	if p, err := g.GetPayload([]byte("1")); err != nil || p != nil {
+		t.Errorf("payload not removed by upsert: %#v %v", p, err)
+	}
+
+	if err := g.InsertWithPayload([]byte("bad"), randomVec(dim), hnswindex.Payload{"f": func() {}}); err == nil {
+		t.Errorf("expected error for payload that can't be encoded")
+	}
+	if _, err := g.GetPayload([]byte("bad")); err == nil {
+		t.Errorf("vector inserted despite bad payload")
+	}
+}
+
+func TestSearchWhere(t *testing.T) {
+	dbname := "test_payload." + RandomString(5)
+	defer os.RemoveAll(dbname)
+
+	idx, err := hnswindex.New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	dim := 16
+	g, err := idx.NewGraph("graph1", dim, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tissues := []string{"tumor", "normal", "blood", "liver"}
+	vmap := map[string][]float32{}
+	payloads := map[string]hnswindex.Payload{}
+	for i := 0; i < 400; i++ {
+		name := fmt.Sprintf("%d", i)
+		vmap[name] = randomVec(dim)
+		payloads[name] = hnswindex.Payload{
+			"tissue": tissues[i%len(tissues)],
+			"age":    i % 100,
+			"tags":   []string{fmt.Sprintf("batch%d", i%10), "all"},
+		}
+		if err := g.InsertWithPayload([]byte(name), vmap[name], payloads[name]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	tests := []struct {
+		filter hnswindex.Filter
+		match  func(p hnswindex.Payload) bool
+	}{
+		{hnswindex.Eq("tissue", "tumor"), func(p hnswindex.Payload) bool { return p["tissue"] == "tumor" }},
+		{hnswindex.Between("age", 40, 60), func(p hnswindex.Payload) bool {
+			a := p["age"].(int)
+			return a >= 40 && a <= 60
+		}},
+		{hnswindex.In("tissue", "blood", "liver"), func(p hnswindex.Payload) bool {
+			return p["tissue"] == "blood" || p["tissue"] == "liver"
+		}},
+		{hnswindex.Eq("tags", "batch3"), func(p hnswindex.Payload) bool { return p["tags"].([]string)[0] == "batch3" }},
+		{hnswindex.And(hnswindex.Eq("tissue", "normal"), hnswindex.Between("age", 0, 10)), func(p hnswindex.Payload) bool {
+			return p["tissue"] == "normal" && p["age"].(int) <= 10
+		}},
+		{hnswindex.Eq("tags", "all"), func(p hnswindex.Payload) bool { return true }},
+	}
+
+	query := randomVec(dim)
+	for i, tc := range tests {
+		scan := distqueue.NewMin[float32, string]()
+		for k, v := range vmap {
+			if tc.match(payloads[k]) {
+				scan.Insert(hnswindex.Euclidean(query, v), k)
+			}
+		}
+		nearest := scan.Ascending()
+		expected := map[string]bool{}
+		for j := 0; j < 10 && j < len(nearest); j++ {
+			expected[nearest[j].Value] = true
+		}
+		out, err := g.SearchWhere(query, 10, 50, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for _, r := range out {
+			if !tc.match(payloads[string(r.Name)]) {
+				t.Errorf("filter %d: result %s does not match", i, r.Name)
+			}
+			if expected[string(r.Name)] {
+				found++
+			}
+		}
+		fmt.Printf("filter %d recall: %d/%d\n", i, found, len(expected))
+		if found < len(expected)*8/10 {
+			t.Errorf("filter %d: recall too low %d/%d", i, found, len(expected))
+		}
+	}
+
+	// every matching vector is scanned when the fraction covers the graph
+	idx.SetExactScanFraction(1)
+	scan := distqueue.NewMin[float32, string]()
+	for k, v := range vmap {
+		scan.Insert(hnswindex.Euclidean(query, v), k)
+	}
+	out, err := g.SearchWhere(query, 10, 50, hnswindex.Eq("tags", "all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range scan.Ascending()[:len(out)] {
+		if string(out[i].Name) != n.Value {
+			t.Errorf("exact scan result %d: %s, expected %s", i, out[i].Name, n.Value)
+		}
+	}
+	if len(out) != 10 {
+		t.Errorf("expected 10 results from exact scan, got %d", len(out))
+	}
+	idx.SetExactScanFraction(0.05)
+	if out, err := g.SearchWhere(query, 10, 50, nil); err != nil || len(out) != 10 {
+		t.Errorf("nil filter should search every vector: %d %v", len(out), err)
+	}
+
+	// index is kept up to date by payload changes and deletes
+	if err := g.SetPayload([]byte("0"), hnswindex.Payload{"tissue": "bone"}); err != nil {
+		t.Error(err)
+	}
+	if err := g.Delete([]byte("1")); err != nil {
+		t.Error(err)
+	}
+	out, err = g.SearchWhere(query, 10, 30, hnswindex.Or(hnswindex.Eq("tissue", "bone"), hnswindex.Eq("age", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"0": true, "101": true, "201": true, "301": true}
+	if len(out) != len(expected) {
+		t.Errorf("expected %d results, got %d", len(expected), len(out))
+	}
+	for _, r := range out {
+		if !expected[string(r.Name)] {
+			t.Errorf("unexpected result %s after payload update and delete", r.Name)
+		}
+	}
+	if _, err := g.SearchWhere(query[:1], 10, 30, hnswindex.Eq("tissue", "tumor")); err == nil {
+		t.Errorf("expected an error for a query with the wrong dimensions")
+	}
+	if _, err := g.SearchWhere(query, 10, 0, hnswindex.Eq("tissue", "tumor")); err == nil {
+		t.Errorf("expected an error for ef=0")
+	}
+	if _, err := g.SearchWhere(query, 10, 30, hnswindex.Eq("tissue", []int{1})); err == nil {
+		t.Errorf("expected error for unsupported filter value")
+	}
+	if out, err := g.SearchWhere(query, 10, 30, hnswindex.Eq("tissue", "tumor")); err != nil || len(out) != 10 {
+		t.Errorf("stale index entry after payload update: %d %v", len(out), err)
+	}
+}
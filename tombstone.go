@@ -0,0 +1,56 @@
+package hnswindex
+
+import (
+	"github.com/cockroachdb/pebble"
+)
+
+// MarkDeleted writes a tombstone for a vector. The node is kept in the graph
+// and still used as a routing hop, but is no longer returned from Search.
+// Tombstoned nodes are physically removed by Vacuum, or replaced by Upsert.
+func (graph *Graph) MarkDeleted(name []byte) error {
+	graph.locks.write.RLock()
+	defer graph.locks.write.RUnlock()
+	if err := graph.checkLive(); err != nil {
+		return err
+	}
+	id, err := graph.db.getVectorID(graph.graphid, name)
+	if err != nil {
+		return err
+	}
+	batch := graph.db.db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(TombstoneKeyEncode(graph.graphid, id), []byte{}, nil); err != nil {
+		return err
+	}
+	return graph.commit(batch)
+}
+
+func (graph *Graph) isDeleted(id uint64) (bool, error) {
+	_, closer, err := graph.reader.Get(TombstoneKeyEncode(graph.graphid, id))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+// tombstoneFilter returns a layerSearch accept function that rejects
+// tombstoned nodes, or nil if the graph has no tombstones
+func (graph *Graph) tombstoneFilter() (func(uint64) (bool, error), error) {
+	prefix := TombstoneGraphPrefix(graph.graphid)
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	if !iter.First() {
+		return nil, nil
+	}
+	return func(id uint64) (bool, error) {
+		deleted, err := graph.isDeleted(id)
+		return !deleted, err
+	}, nil
+}
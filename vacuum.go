@@ -0,0 +1,126 @@
+package hnswindex
+
+import (
+	"context"
+	"math/bits"
+
+	"github.com/cockroachdb/pebble"
+)
+
+type VacuumStats struct {
+	Nodes int //number of tombstoned nodes removed
+	Edges int //number of layer edges removed
+}
+
+// Vacuum physically removes every node marked with MarkDeleted. The edges of
+// the nodes that linked to them are repaired, without linking to other
+// tombstoned nodes, and the key ranges holding the removed nodes are
+// compacted afterwards.
+// Each node is removed in its own batch, so searches can continue while
+// the vacuum runs. If ctx is cancelled, the nodes removed so far are reported
+// along with the context error.
+func (graph *Graph) Vacuum(ctx context.Context) (VacuumStats, error) {
+	stats := VacuumStats{}
+
+	ids, err := graph.listTombstones()
+	if err != nil {
+		return stats, err
+	}
+	if len(ids) == 0 {
+		return stats, nil
+	}
+	exclude := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		exclude[id] = true
+	}
+
+	span := idSpan{}
+	maxLevel := uint8(0)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		level, err := graph.getNodeLevel(id)
+		if err != nil {
+			return stats, err
+		}
+		edges, removed, err := graph.vacuumNode(id, exclude)
+		if err != nil {
+			return stats, err
+		}
+		if !removed {
+			//deleted, or replaced by Upsert, after the tombstones were listed
+			delete(exclude, id)
+			continue
+		}
+		stats.Nodes++
+		stats.Edges += edges
+		span.add(id)
+		maxLevel = max(maxLevel, level)
+	}
+	if stats.Nodes == 0 {
+		return stats, nil
+	}
+
+	for _, r := range graph.vacuumRanges(span, maxLevel) {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err := graph.db.db.Compact(r[0], r[1], true); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// idSpan tracks the first and last of a set of node ids in key order. Ids
+// are little-endian in keys, so key order is not numeric order
+type idSpan struct {
+	lo, hi uint64
+	count  int
+}
+
+func (s *idSpan) add(id uint64) {
+	if s.count == 0 || bits.ReverseBytes64(id) < bits.ReverseBytes64(s.lo) {
+		s.lo = id
+	}
+	if s.count == 0 || bits.ReverseBytes64(id) > bits.ReverseBytes64(s.hi) {
+		s.hi = id
+	}
+	s.count++
+}
+
+// vacuumRanges returns the key ranges to compact after removing the nodes
+// in span. The per-node keys are limited to the span, while the edges of
+// every layer up to maxLevel are compacted in full, as the removed edges
+// and the pruned links of repaired neighbors are keyed by other nodes
+func (graph *Graph) vacuumRanges(span idSpan, maxLevel uint8) [][2][]byte {
+	out := [][2][]byte{}
+	nodeKeys := []func(uint32, uint64) []byte{
+		VectorKeyEncode, NameRevKeyEncode, LevelKeyEncode, TombstoneKeyEncode, PayloadKeyEncode,
+	}
+	for _, enc := range nodeKeys {
+		out = append(out, [2][]byte{enc(graph.graphid, span.lo), PrefixEnd(enc(graph.graphid, span.hi))})
+	}
+	for l := 0; l <= int(maxLevel); l++ {
+		for _, prefix := range [][]byte{LayerPrefixEncode(graph.graphid, uint8(l)), LayerRevPrefixEncode(graph.graphid, uint8(l))} {
+			out = append(out, [2][]byte{prefix, PrefixEnd(prefix)})
+		}
+	}
+	return out
+}
+
+func (graph *Graph) listTombstones() ([]uint64, error) {
+	prefix := TombstoneGraphPrefix(graph.graphid)
+	iter, err := graph.reader.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	out := []uint64{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, id := TombstoneKeyParse(iter.Key())
+		out = append(out, id)
+	}
+	return out, nil
+}